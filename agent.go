@@ -0,0 +1,63 @@
+/*
+License: The MIT License (MIT)
+
+Copyright (c) 2016 Joe Linoff
+
+Permission is hereby granted, free of charge, to any person obtaining
+a copy of this software and associated documentation files (the
+"Software"), to deal in the Software without restriction, including
+without limitation the rights to use, copy, modify, merge, publish,
+distribute, sublicense, and/or sell copies of the Software, and to
+permit persons to whom the Software is furnished to do so, subject
+to the following conditions:
+
+The above copyright notice and this permission notice shall be
+included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR
+ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+import (
+	"net"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// agentSigners returns the signers for the keys held by the
+// running ssh-agent. The connection to the agent stays open for
+// the whole run because the agent does the signing. It is safe
+// to share between the goroutines.
+// Nil is returned if there is no agent, that is not an error
+// because agent authentication is enabled by default.
+func agentSigners(opts options) []ssh.Signer {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if len(sock) == 0 {
+		vinfo(opts, "   agent: SSH_AUTH_SOCK is not set")
+		return nil
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		vinfo(opts, "   agent: %v", err)
+		return nil
+	}
+	signers, err := agent.NewClient(conn).Signers()
+	if err != nil {
+		vinfo(opts, "   agent: %v", err)
+		conn.Close()
+		return nil
+	}
+	vinfo(opts, "   agent: %v keys", len(signers))
+	for _, s := range signers {
+		vinfon(opts, 2, "      %v %v", s.PublicKey().Type(), ssh.FingerprintSHA256(s.PublicKey()))
+	}
+	return signers
+}
@@ -0,0 +1,256 @@
+/*
+License: The MIT License (MIT)
+
+Copyright (c) 2016 Joe Linoff
+
+Permission is hereby granted, free of charge, to any person obtaining
+a copy of this software and associated documentation files (the
+"Software"), to deal in the Software without restriction, including
+without limitation the rights to use, copy, modify, merge, publish,
+distribute, sublicense, and/or sell copies of the Software, and to
+permit persons to whom the Software is furnished to do so, subject
+to the following conditions:
+
+The above copyright notice and this permission notice shall be
+included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR
+ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// outputGroup is a set of hosts whose output and exit status are
+// identical.
+type outputGroup struct {
+	Stdout string
+	Stderr string
+	Exit   string
+	Error  string
+	Hosts  []hostinfo
+}
+
+// collateOutput returns the remote output of a job without the
+// sshx error lines. Those name the job and the host so they would
+// keep the hosts that failed the same way from being grouped.
+func collateOutput(hi hostinfo, mode string) (stdout string, stderr string) {
+	remote := hi
+	remote.Lines = nil
+	remote.Output = ""
+	for _, line := range hi.Lines {
+		if line.Stream != "sshx" {
+			remote.Lines = append(remote.Lines, line)
+			remote.Output += line.Text + "\n"
+		}
+	}
+	return formatOutput(remote, mode)
+}
+
+// collateError returns the error of a job with the host replaced
+// so that the same error from different hosts is identical.
+func collateError(hi hostinfo) string {
+	return strings.Replace(hi.Error, hi.Host, "<host>", -1)
+}
+
+// collate groups the jobs with identical output and prints each
+// distinct output once. The largest group is the majority, the
+// other groups are followed by the differences from it.
+func collate(results []hostinfo, opts options) {
+	groups := []*outputGroup{}
+	index := map[string]*outputGroup{}
+	for _, hi := range results {
+		stdout, stderr := collateOutput(hi, opts.StderrMode)
+		exit := exitString(hi)
+		e := collateError(hi)
+		key := stdout + "\x00" + stderr + "\x00" + exit + "\x00" + e
+		g, found := index[key]
+		if !found {
+			g = &outputGroup{Stdout: stdout, Stderr: stderr, Exit: exit, Error: e}
+			index[key] = g
+			groups = append(groups, g)
+		}
+		g.Hosts = append(g.Hosts, hi)
+	}
+
+	// Biggest groups first, ties in job order.
+	sort.SliceStable(groups, func(i, j int) bool {
+		return len(groups[i].Hosts) > len(groups[j].Hosts)
+	})
+
+	for i, g := range groups {
+		names := []string{}
+		for _, hi := range g.Hosts {
+			names = append(names, strings.TrimSuffix(hi.Host, ":22"))
+		}
+		if opts.JobHeader {
+			fmt.Printf(`
+# ================================================================
+# Hosts: %[1]v
+# Count: %[2]v of %[3]v
+# Exit : %[4]v
+`, compactHosts(names), len(g.Hosts), len(results), g.Exit)
+			if len(g.Error) > 0 {
+				fmt.Printf("# Error: %v\n", g.Error)
+			}
+			fmt.Printf("# ================================================================\n")
+		} else if len(g.Error) > 0 {
+			fmt.Fprintf(os.Stderr, "ERROR: %v - %v\n", compactHosts(names), g.Error)
+		}
+		fmt.Print(g.Stdout)
+		fmt.Fprint(os.Stderr, g.Stderr)
+		if i > 0 {
+			fmt.Printf("# ---------------------- diff from majority ----------------------\n")
+			fmt.Print(lineDiff(groups[0].Stdout+groups[0].Stderr, g.Stdout+g.Stderr))
+			if g.Exit != groups[0].Exit {
+				fmt.Printf("-# Exit : %v\n+# Exit : %v\n", groups[0].Exit, g.Exit)
+			}
+			if g.Error != groups[0].Error {
+				fmt.Printf("-# Error: %v\n+# Error: %v\n", groups[0].Error, g.Error)
+			}
+		}
+	}
+}
+
+// compactHosts reports the host names as ranges where the names
+// only differ by a number.
+//    web01 web02 web03 web07 db1 -> db1,web[01-03,07]
+// Zero padded numbers are only combined with numbers of the same
+// width so that the names can be recreated from the ranges.
+func compactHosts(names []string) string {
+	type series struct {
+		prefix string
+		suffix string
+		width  int // zero padding, 0 if there is none
+		nums   []int
+	}
+	re := regexp.MustCompile(`^(.*?)(\d+)(\D*)$`)
+	all := map[string]*series{}
+	keys := []string{}
+	for _, name := range names {
+		prefix, suffix, width, num := name, "", 0, -1
+		if m := re.FindStringSubmatch(name); m != nil && len(m[2]) < 10 {
+			prefix, suffix = m[1], m[3]
+			num, _ = strconv.Atoi(m[2])
+			if len(m[2]) > 1 && strings.HasPrefix(m[2], "0") {
+				width = len(m[2])
+			}
+		}
+		key := fmt.Sprintf("%v\x00%v\x00%v", prefix, suffix, width)
+		if num < 0 {
+			key = name
+		}
+		s, found := all[key]
+		if !found {
+			s = &series{prefix: prefix, suffix: suffix, width: width}
+			all[key] = s
+			keys = append(keys, key)
+		}
+		if num >= 0 {
+			s.nums = append(s.nums, num)
+		}
+	}
+
+	sort.Strings(keys)
+	result := []string{}
+	for _, key := range keys {
+		s := all[key]
+		if len(s.nums) == 0 {
+			result = append(result, s.prefix)
+			continue
+		}
+		format := func(n int) string {
+			return fmt.Sprintf("%0*d", s.width, n)
+		}
+		sort.Ints(s.nums)
+		nums := []int{}
+		for i, n := range s.nums {
+			if i == 0 || n != s.nums[i-1] {
+				nums = append(nums, n)
+			}
+		}
+		s.nums = nums
+		ranges := []string{}
+		for i := 0; i < len(s.nums); {
+			j := i
+			for j+1 < len(s.nums) && s.nums[j+1] <= s.nums[j]+1 {
+				j++
+			}
+			if s.nums[i] == s.nums[j] {
+				ranges = append(ranges, format(s.nums[i]))
+			} else {
+				ranges = append(ranges, format(s.nums[i])+"-"+format(s.nums[j]))
+			}
+			i = j + 1
+		}
+		if len(ranges) == 1 && len(s.nums) == 1 {
+			result = append(result, s.prefix+ranges[0]+s.suffix)
+		} else {
+			result = append(result, s.prefix+"["+strings.Join(ranges, ",")+"]"+s.suffix)
+		}
+	}
+	return strings.Join(result, ",")
+}
+
+// lineDiff returns the lines that were removed from a (-) and
+// added in b (+) using the longest common subsequence of lines.
+func lineDiff(a string, b string) string {
+	split := func(s string) []string {
+		if len(s) == 0 {
+			return nil
+		}
+		return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+	}
+	al := split(a)
+	bl := split(b)
+	if len(al)*len(bl) > 4000000 {
+		return "# the outputs are too large to compare\n"
+	}
+
+	// lcs[i][j] is the length of the common subsequence of al[i:]
+	// and bl[j:].
+	lcs := make([][]int, len(al)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bl)+1)
+	}
+	for i := len(al) - 1; i >= 0; i-- {
+		for j := len(bl) - 1; j >= 0; j-- {
+			if al[i] == bl[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	diff := ""
+	i, j := 0, 0
+	for i < len(al) || j < len(bl) {
+		switch {
+		case i < len(al) && j < len(bl) && al[i] == bl[j]:
+			i++
+			j++
+		case i < len(al) && (j == len(bl) || lcs[i+1][j] >= lcs[i][j+1]):
+			diff += "-" + al[i] + "\n"
+			i++
+		default:
+			diff += "+" + bl[j] + "\n"
+			j++
+		}
+	}
+	return diff
+}
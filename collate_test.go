@@ -0,0 +1,75 @@
+/*
+License: The MIT License (MIT)
+
+Copyright (c) 2016 Joe Linoff
+
+Permission is hereby granted, free of charge, to any person obtaining
+a copy of this software and associated documentation files (the
+"Software"), to deal in the Software without restriction, including
+without limitation the rights to use, copy, modify, merge, publish,
+distribute, sublicense, and/or sell copies of the Software, and to
+permit persons to whom the Software is furnished to do so, subject
+to the following conditions:
+
+The above copyright notice and this permission notice shall be
+included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR
+ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+import (
+	"testing"
+)
+
+func TestCompactHosts(t *testing.T) {
+	tests := []struct {
+		names []string
+		want  string
+	}{
+		{[]string{"web05"}, "web05"},
+		{[]string{"web01", "web02", "web03", "web07", "db1"}, "db1,web[01-03,07]"},
+		{[]string{"web9", "web10", "web11"}, "web[9-11]"},
+		{[]string{"web01", "web1", "web002"}, "web1,web01,web002"},
+		{[]string{"web0", "web1"}, "web[0-1]"},
+		{[]string{"web01", "web01", "web02"}, "web[01-02]"},
+		{[]string{"web01", "web01"}, "web01"},
+		{[]string{"foo", "bar", "foo"}, "bar,foo"},
+		{[]string{"10.0.0.1", "10.0.0.2", "10.0.0.10"}, "10.0.0.[1-2,10]"},
+		{[]string{"10.0.0.1", "10.0.1.1"}, "10.0.0.1,10.0.1.1"},
+		{[]string{"rack1-web", "rack2-web"}, "rack[1-2]-web"},
+		{[]string{"127.0.0.1:2222", "127.0.0.1:2223"}, "127.0.0.1:[2222-2223]"},
+	}
+	for _, tt := range tests {
+		if got := compactHosts(tt.names); got != tt.want {
+			t.Errorf("compactHosts(%q) = %q, want %q", tt.names, got, tt.want)
+		}
+	}
+}
+
+func TestLineDiff(t *testing.T) {
+	tests := []struct {
+		a    string
+		b    string
+		want string
+	}{
+		{"", "", ""},
+		{"a\nb\n", "a\nb\n", ""},
+		{"", "x\n", "+x\n"},
+		{"a\nb\n", "", "-a\n-b\n"},
+		{"a\nb\nc\n", "a\nx\nc\nd\n", "-b\n+x\n+d\n"},
+		{"a\nb\n", "b\na\n", "-a\n+a\n"},
+		{"a\nb", "a\nb\n", ""},
+	}
+	for _, tt := range tests {
+		if got := lineDiff(tt.a, tt.b); got != tt.want {
+			t.Errorf("lineDiff(%q, %q) = %q, want %q", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
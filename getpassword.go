@@ -26,13 +26,23 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
-	"os/signal"
+	"sync"
 	"syscall"
 
 	"golang.org/x/crypto/ssh/terminal"
 )
 
+// promptMutex serializes the prompts from hosts that are
+// authenticating concurrently.
+var promptMutex sync.Mutex
+
+// promptWriter is where the prompts are written. It is stderr for
+// the json and ndjson output formats so that stdout only has the
+// records.
+var promptWriter io.Writer = os.Stdout
+
 func getPassword(prompt string) string {
 	// Get the initial state of the terminal.
 	initialTermState, e1 := terminal.GetState(syscall.Stdin)
@@ -42,25 +52,17 @@ func getPassword(prompt string) string {
 
 	// Restore it in the event of an interrupt.
 	// CITATION: Konstantin Shaposhnikov - https://groups.google.com/forum/#!topic/golang-nuts/kTVAbtee9UA
-	c := make(chan os.Signal)
-	signal.Notify(c, os.Interrupt, os.Kill)
-	go func() {
-		<-c
-		_ = terminal.Restore(syscall.Stdin, initialTermState)
-		os.Exit(1)
-	}()
+	interruptTerminal(initialTermState)
+	defer interruptTerminal(nil)
 
 	// Now get the password.
-	fmt.Print(prompt)
+	fmt.Fprint(promptWriter, prompt)
 	p, err := terminal.ReadPassword(syscall.Stdin)
-	fmt.Println("")
+	fmt.Fprintln(promptWriter, "")
 	if err != nil {
 		panic(err)
 	}
 
-	// Stop looking for ^C on the channel.
-	signal.Stop(c)
-
 	// Return the password as a string.
 	return string(p)
 }
@@ -0,0 +1,379 @@
+/*
+License: The MIT License (MIT)
+
+Copyright (c) 2016 Joe Linoff
+
+Permission is hereby granted, free of charge, to any person obtaining
+a copy of this software and associated documentation files (the
+"Software"), to deal in the Software without restriction, including
+without limitation the rights to use, copy, modify, merge, publish,
+distribute, sublicense, and/or sell copies of the Software, and to
+permit persons to whom the Software is furnished to do so, subject
+to the following conditions:
+
+The above copyright notice and this permission notice shall be
+included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR
+ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// hostKeyChecker verifies the server host keys against the
+// known_hosts files. It is created once per run and shared by
+// all of the hosts.
+type hostKeyChecker struct {
+	policy   string // strict, accept-new or off
+	store    string // sshx managed known_hosts file for accept-new
+	files    []string
+	callback ssh.HostKeyCallback // from knownhosts.New
+	mutex    sync.Mutex          // protects accepted and the store
+	accepted map[string]ssh.PublicKey
+
+	// @cert-authority lines by "file:line", knownhosts reports
+	// them along with the host keys.
+	authorities map[string]bool
+
+	// The known_hosts files by the name of the copy without the
+	// lines that cannot be parsed.
+	copies map[string]string
+}
+
+// defaultKnownHostsFiles returns the known_hosts files that ssh
+// uses by default: the invoking user's file and the system file.
+func defaultKnownHostsFiles() (files []string) {
+	if u, err := user.Current(); err == nil {
+		files = append(files, path.Join(u.HomeDir, ".ssh", "known_hosts"))
+	}
+	files = append(files, "/etc/ssh/ssh_known_hosts")
+	return
+}
+
+// defaultKnownHostsStore returns the known_hosts file that sshx
+// owns. New keys are only ever written here, never to the user's
+// ~/.ssh/known_hosts.
+func defaultKnownHostsStore() string {
+	if u, err := user.Current(); err == nil {
+		return path.Join(u.HomeDir, ".ssh", "sshx_known_hosts")
+	}
+	return ""
+}
+
+// newHostKeyChecker loads the known_hosts files. Files that do
+// not exist are skipped, which means that every host is unknown
+// if none of them exist.
+func newHostKeyChecker(opts options) *hostKeyChecker {
+	hkc := &hostKeyChecker{
+		policy:      opts.HostKeyPolicy,
+		store:       opts.KnownHostsStore,
+		accepted:    map[string]ssh.PublicKey{},
+		authorities: map[string]bool{},
+		copies:      map[string]string{},
+	}
+	vinfo(opts, "   host key policy: %v", hkc.policy)
+	if hkc.policy == "off" {
+		return hkc
+	}
+	files := append([]string{}, opts.KnownHostsFiles...)
+	if len(hkc.store) > 0 {
+		files = append(files, hkc.store)
+	}
+	for _, fn := range files {
+		if _, err := os.Stat(fn); err == nil {
+			vinfo(opts, "   known_hosts: %v", fn)
+			hkc.files = append(hkc.files, fn)
+		} else {
+			vinfon(opts, 2, "   known_hosts: %v not found", fn)
+		}
+	}
+	names := []string{}
+	for _, fn := range hkc.files {
+		names = append(names, hkc.loadKnownHosts(opts, fn))
+	}
+	cb, err := knownhosts.New(names...)
+	for name := range hkc.copies {
+		os.Remove(name)
+	}
+	check(err)
+	hkc.callback = cb
+	return hkc
+}
+
+// loadKnownHosts remembers the @cert-authority lines in a
+// known_hosts file and skips the lines that cannot be parsed,
+// like keys of a type that x/crypto does not support, the same way
+// that ssh does. Otherwise knownhosts would reject the whole file.
+// The name of the file to load is returned, it is a copy with the
+// bad lines blanked out if there are any so that the line numbers
+// match the ones that the knownhosts package reports.
+func (hkc *hostKeyChecker) loadKnownHosts(opts options, fn string) string {
+	data, err := os.ReadFile(fn)
+	check(err)
+
+	lines := strings.Split(string(data), "\n")
+	skipped := 0
+	for i, line := range lines {
+		lineno := i + 1
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := parseKnownHostsLine(line); err != nil {
+			vinfo(opts, "   known_hosts: %v:%v skipped: %v", fn, lineno, err)
+			lines[i] = ""
+			skipped++
+			continue
+		}
+		if strings.HasPrefix(line, "@cert-authority") {
+			vinfon(opts, 2, "   cert-authority: %v:%v", fn, lineno)
+			hkc.authorities[fmt.Sprintf("%v:%v", fn, lineno)] = true
+		}
+	}
+	if skipped == 0 {
+		return fn
+	}
+
+	// The copy is removed as soon as knownhosts has read it.
+	tf, err := os.CreateTemp("", "sshx-known_hosts-")
+	check(err)
+	defer tf.Close()
+	_, err = tf.WriteString(strings.Join(lines, "\n"))
+	check(err)
+	hkc.copies[tf.Name()] = fn
+	return tf.Name()
+}
+
+// parseKnownHostsLine reports why the knownhosts package cannot
+// parse a known_hosts line:
+//    [@cert-authority|@revoked] <patterns> <type> <base64> [<comment>]
+func parseKnownHostsLine(line string) error {
+	flds := strings.Fields(line)
+	if strings.HasPrefix(flds[0], "@") {
+		if flds[0] != "@cert-authority" && flds[0] != "@revoked" {
+			return fmt.Errorf("unexpected marker %q", flds[0])
+		}
+		flds = flds[1:]
+	}
+	if len(flds) < 3 {
+		return fmt.Errorf("expected <patterns> <type> <key>")
+	}
+	data, err := base64.StdEncoding.DecodeString(flds[2])
+	if err != nil {
+		return err
+	}
+	key, err := ssh.ParsePublicKey(data)
+	if err != nil {
+		return err
+	}
+	if key.Type() != flds[1] {
+		return fmt.Errorf("key type mismatch: found %q, want %q", key.Type(), flds[1])
+	}
+	return nil
+}
+
+// filename returns the known_hosts file that knownhosts reports
+// a key from, the copies are only used to load them.
+func (hkc *hostKeyChecker) filename(name string) string {
+	if fn, found := hkc.copies[name]; found {
+		return fn
+	}
+	return name
+}
+
+// hostKeys removes the certificate authorities from the keys
+// that knownhosts found for a host.
+func (hkc *hostKeyChecker) hostKeys(keys []knownhosts.KnownKey) (result []knownhosts.KnownKey) {
+	for _, k := range keys {
+		k.Filename = hkc.filename(k.Filename)
+		if hkc.authorities[fmt.Sprintf("%v:%v", k.Filename, k.Line)] == false {
+			result = append(result, k)
+		}
+	}
+	return
+}
+
+// plainHostKeyAlgorithms returns the supported host key
+// algorithms without the certificate algorithms. It is used when
+// there is no certificate authority for the host so that the
+// server does not present a certificate that cannot be verified.
+func plainHostKeyAlgorithms() (algs []string) {
+	for _, a := range ssh.SupportedAlgorithms().HostKeys {
+		if strings.Contains(a, "-cert-") == false {
+			algs = append(algs, a)
+		}
+	}
+	return
+}
+
+// check is the ssh.HostKeyCallback. It converts the knownhosts
+// errors into messages that say what went wrong.
+// Unknown hosts are added to the store for the accept-new policy
+// but changed keys are always rejected.
+func (hkc *hostKeyChecker) check(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	if hkc.policy == "off" {
+		return nil
+	}
+	err := hkc.callback(hostname, remote, key)
+	if err == nil {
+		return nil
+	}
+	if e, ok := err.(*knownhosts.KeyError); ok {
+		// A plain key for a host that only has a certificate
+		// authority is an unknown key, not a mismatch.
+		e.Want = hkc.hostKeys(e.Want)
+		if len(e.Want) == 0 && hkc.policy == "accept-new" {
+			return hkc.accept(hostname, key)
+		}
+	}
+	fp := ssh.FingerprintSHA256(key)
+	if cert, ok := key.(*ssh.Certificate); ok {
+		// The principals, validity window, revocation and signing
+		// authority were checked by the knownhosts package.
+		return fmt.Errorf("host certificate for %v rejected: %v (serial %v, signed by %v %v)",
+			hostname, err, cert.Serial, cert.SignatureKey.Type(), ssh.FingerprintSHA256(cert.SignatureKey))
+	}
+	switch e := err.(type) {
+	case *knownhosts.RevokedError:
+		return fmt.Errorf("host key for %v is revoked: %v %v (%v:%v)",
+			hostname, key.Type(), fp, hkc.filename(e.Revoked.Filename), e.Revoked.Line)
+	case *knownhosts.KeyError:
+		if len(e.Want) == 0 {
+			return fmt.Errorf("host key for %v not found in known_hosts: %v %v",
+				hostname, key.Type(), fp)
+		}
+		wants := []string{}
+		for _, w := range e.Want {
+			wants = append(wants, fmt.Sprintf("%v %v (%v:%v)",
+				w.Key.Type(), ssh.FingerprintSHA256(w.Key), w.Filename, w.Line))
+		}
+		return fmt.Errorf("host key mismatch for %v: server sent %v %v, expected %v",
+			hostname, key.Type(), fp, strings.Join(wants, ", "))
+	}
+	return err
+}
+
+// pinned returns the ssh.HostKeyCallback for a host whose key
+// fingerprint was specified in the host spec. Only that key is
+// accepted, the known_hosts files are not consulted.
+func pinned(fingerprint string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		fp := ssh.FingerprintSHA256(key)
+		if fp == fingerprint {
+			return nil
+		}
+		return fmt.Errorf("host key mismatch for %v: server sent %v %v, expected pinned %v",
+			hostname, key.Type(), fp, fingerprint)
+	}
+}
+
+// accept records the key of a host that is not in any of the
+// known_hosts files. It is called from many goroutines at once so
+// the first key seen for a host in this run wins and the others
+// must match it.
+func (hkc *hostKeyChecker) accept(hostname string, key ssh.PublicKey) error {
+	hkc.mutex.Lock()
+	defer hkc.mutex.Unlock()
+
+	addr := knownhosts.Normalize(hostname)
+	if k, found := hkc.accepted[addr]; found {
+		if bytes.Equal(k.Marshal(), key.Marshal()) {
+			return nil
+		}
+		return fmt.Errorf("host key mismatch for %v: server sent %v %v, expected %v %v (accepted earlier in this run)",
+			hostname, key.Type(), ssh.FingerprintSHA256(key), k.Type(), ssh.FingerprintSHA256(k))
+	}
+
+	if len(hkc.store) == 0 {
+		return fmt.Errorf("host key for %v not found in known_hosts and there is no store to add it to", hostname)
+	}
+	if err := os.MkdirAll(path.Dir(hkc.store), 0700); err != nil {
+		return err
+	}
+
+	// Write the entire line in a single append so that concurrent
+	// sshx runs cannot interleave partial entries.
+	fp, err := os.OpenFile(hkc.store, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	line := knownhosts.Line([]string{addr}, key) + "\n"
+	if _, err := fp.WriteString(line); err != nil {
+		return err
+	}
+	hkc.accepted[addr] = key
+	warning("permanently added %v key %v for %v to %v", key.Type(), ssh.FingerprintSHA256(key), addr, hkc.store)
+	return nil
+}
+
+// algorithms returns the host key algorithms for the key types
+// that are already known for the host. Offering only those makes
+// the server send a key that can actually be verified instead of
+// reporting a mismatch for a key type that was never recorded.
+// Certificates are only requested if there is a certificate
+// authority for the host.
+// Nil is returned when the defaults should be used.
+func (hkc *hostKeyChecker) algorithms(hostname string) (algs []string) {
+	if hkc.policy == "off" {
+		return
+	}
+	// Look the host up with a throw away key, the KeyError lists
+	// the known keys.
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return
+	}
+	probe, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return
+	}
+	remote := &net.TCPAddr{IP: net.IPv4zero}
+	e, ok := hkc.callback(hostname, remote, probe).(*knownhosts.KeyError)
+	if !ok {
+		return
+	}
+	keys := hkc.hostKeys(e.Want)
+	if len(keys) < len(e.Want) {
+		// There is a certificate authority, the defaults prefer
+		// certificates.
+		return
+	}
+	if len(keys) == 0 {
+		return plainHostKeyAlgorithms()
+	}
+	seen := map[string]bool{}
+	for _, w := range keys {
+		t := w.Key.Type()
+		if seen[t] {
+			continue
+		}
+		seen[t] = true
+		if t == ssh.KeyAlgoRSA {
+			algs = append(algs, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256)
+		}
+		algs = append(algs, t)
+	}
+	return
+}
@@ -0,0 +1,187 @@
+/*
+License: The MIT License (MIT)
+
+Copyright (c) 2016 Joe Linoff
+
+Permission is hereby granted, free of charge, to any person obtaining
+a copy of this software and associated documentation files (the
+"Software"), to deal in the Software without restriction, including
+without limitation the rights to use, copy, modify, merge, publish,
+distribute, sublicense, and/or sell copies of the Software, and to
+permit persons to whom the Software is furnished to do so, subject
+to the following conditions:
+
+The above copyright notice and this permission notice shall be
+included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR
+ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// newTestKey returns a new ed25519 public key.
+func newTestKey(t *testing.T) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// writeKnownHosts writes a known_hosts file in the test directory.
+func writeKnownHosts(t *testing.T, dir string, name string, lines ...string) string {
+	fn := filepath.Join(dir, name)
+	data := strings.Join(lines, "\n") + "\n"
+	if err := os.WriteFile(fn, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+func TestHostKeyCheck(t *testing.T) {
+	keyA := newTestKey(t)
+	keyB := newTestKey(t)
+	ca := newTestKey(t)
+	authorityLine := "@cert-authority *.example.com " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(ca)))
+	revokedLine := "@revoked * " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(keyB)))
+	xmssLine := "host1 ssh-xmss@openssh.com AAAAFHNzaC14bXNzQG9wZW5zc2guY29tAAAAFVhNU1NfU0hBMi0yNTZfVzE2X0gxMAAAAEA="
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 22}
+
+	tests := []struct {
+		name     string
+		policy   string
+		known    []string // known_hosts lines
+		host     string
+		key      ssh.PublicKey
+		errText  string // expected error, empty if the key is accepted
+		accepted bool   // the key was added to the store
+	}{
+		{"known key", "strict", []string{knownhosts.Line([]string{"host1"}, keyA)}, "host1:22", keyA, "", false},
+		{"known key on a port", "strict", []string{knownhosts.Line([]string{"[host1]:2222"}, keyA)}, "host1:2222", keyA, "", false},
+		{"changed key", "strict", []string{knownhosts.Line([]string{"host1"}, keyA)}, "host1:22", keyB, "host key mismatch for host1:22", false},
+		{"unknown host", "strict", []string{knownhosts.Line([]string{"host1"}, keyA)}, "host2:22", keyA, "not found in known_hosts", false},
+		{"revoked key", "strict", []string{revokedLine}, "host1:22", keyB, "is revoked", false},
+		{"unknown host accepted", "accept-new", []string{knownhosts.Line([]string{"host1"}, keyA)}, "host2:22", keyB, "", true},
+		{"changed key not accepted", "accept-new", []string{knownhosts.Line([]string{"host1"}, keyA)}, "host1:22", keyB, "host key mismatch for host1:22", false},
+		{"authority is not a mismatch", "accept-new", []string{authorityLine}, "web.example.com:22", keyA, "", true},
+		{"authority is unknown when strict", "strict", []string{authorityLine}, "web.example.com:22", keyA, "not found in known_hosts", false},
+		{"bad lines are skipped", "strict", []string{xmssLine, "host1 ssh-ed25519 !!!", knownhosts.Line([]string{"host1"}, keyA)}, "host1:22", keyA, "", false},
+		{"bad lines keep the line numbers", "strict", []string{xmssLine, knownhosts.Line([]string{"host1"}, keyA)}, "host1:22", keyB, "known_hosts:2)", false},
+		{"off", "off", nil, "host1:22", keyB, "", false},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		store := filepath.Join(dir, "sshx_known_hosts")
+		opts := options{
+			HostKeyPolicy:   tt.policy,
+			KnownHostsFiles: []string{writeKnownHosts(t, dir, "known_hosts", tt.known...)},
+			KnownHostsStore: store,
+		}
+		hkc := newHostKeyChecker(opts)
+		err := hkc.check(tt.host, remote, tt.key)
+		if len(tt.errText) == 0 && err != nil {
+			t.Errorf("%v: check = %v, want no error", tt.name, err)
+		}
+		if len(tt.errText) > 0 && (err == nil || strings.Contains(err.Error(), tt.errText) == false) {
+			t.Errorf("%v: check = %v, want %q", tt.name, err, tt.errText)
+		}
+
+		data, _ := os.ReadFile(store)
+		want := ""
+		if tt.accepted {
+			want = knownhosts.Line([]string{knownhosts.Normalize(tt.host)}, tt.key) + "\n"
+		}
+		if string(data) != want {
+			t.Errorf("%v: store = %q, want %q", tt.name, data, want)
+		}
+
+		// The next run finds the accepted key in the store.
+		if tt.accepted {
+			hkc = newHostKeyChecker(opts)
+			if err := hkc.check(tt.host, remote, tt.key); err != nil {
+				t.Errorf("%v: check after accept = %v, want no error", tt.name, err)
+			}
+			if err := hkc.check(tt.host, remote, newTestKey(t)); err == nil {
+				t.Errorf("%v: check of another key after accept = nil, want a mismatch", tt.name)
+			}
+		}
+	}
+}
+
+func TestHostKeyAcceptConcurrent(t *testing.T) {
+	keys := []ssh.PublicKey{newTestKey(t), newTestKey(t)}
+	dir := t.TempDir()
+	opts := options{
+		HostKeyPolicy:   "accept-new",
+		KnownHostsFiles: []string{writeKnownHosts(t, dir, "known_hosts")},
+		KnownHostsStore: filepath.Join(dir, "sshx_known_hosts"),
+	}
+	hkc := newHostKeyChecker(opts)
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 22}
+
+	// Many hosts connect to the same host at once, the first key
+	// seen wins and the other key is a mismatch.
+	const n = 32
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = hkc.check("host1:22", remote, keys[i%2])
+		}(i)
+	}
+	wg.Wait()
+
+	winner := -1
+	for i, err := range errs {
+		if err == nil {
+			winner = i % 2
+			break
+		}
+	}
+	if winner < 0 {
+		t.Fatalf("no key was accepted: %v", errs[0])
+	}
+	for i, err := range errs {
+		if i%2 == winner && err != nil {
+			t.Errorf("check %v of the accepted key = %v, want no error", i, err)
+		}
+		if i%2 != winner && (err == nil || strings.Contains(err.Error(), "accepted earlier in this run") == false) {
+			t.Errorf("check %v of the other key = %v, want a mismatch", i, err)
+		}
+	}
+
+	data, err := os.ReadFile(opts.KnownHostsStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("%v\n", knownhosts.Line([]string{"host1"}, keys[winner]))
+	if string(data) != want {
+		t.Errorf("store = %q, want %q", data, want)
+	}
+}
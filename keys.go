@@ -0,0 +1,233 @@
+/*
+License: The MIT License (MIT)
+
+Copyright (c) 2016 Joe Linoff
+
+Permission is hereby granted, free of charge, to any person obtaining
+a copy of this software and associated documentation files (the
+"Software"), to deal in the Software without restriction, including
+without limitation the rights to use, copy, modify, merge, publish,
+distribute, sublicense, and/or sell copies of the Software, and to
+permit persons to whom the Software is furnished to do so, subject
+to the following conditions:
+
+The above copyright notice and this permission notice shall be
+included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR
+ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// privateKeySigner returns the signer for a private key file.
+// Encrypted keys are decrypted with the --passphrase-file or
+// --passphrase-env passphrase if there is one, otherwise the user
+// is prompted once for each key.
+// The user is only prompted when the key is needed, after a server
+// said that it would accept the key, like ssh does. That only
+// works if the public key is known without the passphrase, from
+// the key file itself or from the .pub file next to it.
+// The result is cached so that each key is only loaded once per
+// run no matter how many hosts use it. A key that could not be
+// loaded is cached as nil so that the user is not asked again.
+func privateKeySigner(opts options, keyFile string) (ssh.Signer, error) {
+	if signer, found := opts.KeyCache[keyFile]; found {
+		if signer == nil {
+			return nil, fmt.Errorf("%v could not be loaded", keyFile)
+		}
+		return signer, nil
+	}
+	opts.KeyCache[keyFile] = nil
+
+	key, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if e, ok := err.(*ssh.PassphraseMissingError); ok {
+		pub := e.PublicKey
+		if pub == nil {
+			pub = readPublicKey(keyFile + ".pub")
+		}
+		if pub != nil {
+			signer, err = &encryptedSigner{opts: opts, keyFile: keyFile, key: key, pub: pub}, nil
+		} else {
+			signer, err = decryptPrivateKey(opts, keyFile, key)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	opts.KeyCache[keyFile] = signer
+	return signer, nil
+}
+
+// decryptPrivateKey decrypts an encrypted private key.
+func decryptPrivateKey(opts options, keyFile string, key []byte) (ssh.Signer, error) {
+	passphrase := opts.Passphrase
+	if len(passphrase) == 0 {
+		// The hosts authenticate concurrently so only one of them
+		// can talk to the user at a time.
+		promptMutex.Lock()
+		defer promptMutex.Unlock()
+		passphrase = getPassword(fmt.Sprintf("Enter passphrase for key '%v': ", keyFile))
+	}
+	return ssh.ParsePrivateKeyWithPassphrase(key, []byte(passphrase))
+}
+
+// readPublicKey reads the public key of an encrypted private key,
+// nil is returned if it cannot be read.
+func readPublicKey(fn string) ssh.PublicKey {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil
+	}
+	return pub
+}
+
+// encryptedSigner is the signer for an encrypted private key. The
+// key is decrypted the first time that something is signed, the
+// ssh package only signs after the server accepted the public key.
+// If the key cannot be decrypted the authentication fails.
+type encryptedSigner struct {
+	opts    options
+	keyFile string
+	key     []byte
+	pub     ssh.PublicKey
+	mutex   sync.Mutex // protects signer and err
+	signer  ssh.Signer
+	err     error
+}
+
+func (s *encryptedSigner) PublicKey() ssh.PublicKey {
+	return s.pub
+}
+
+func (s *encryptedSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	signer, err := s.decrypt()
+	if err != nil {
+		return nil, err
+	}
+	return signer.Sign(rand, data)
+}
+
+func (s *encryptedSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	signer, err := s.decrypt()
+	if err != nil {
+		return nil, err
+	}
+	as, ok := signer.(ssh.AlgorithmSigner)
+	if !ok {
+		return nil, fmt.Errorf("%v does not support the %v signature algorithm", s.keyFile, algorithm)
+	}
+	return as.SignWithAlgorithm(rand, data, algorithm)
+}
+
+// decrypt decrypts the key once, the other hosts wait for it.
+func (s *encryptedSigner) decrypt() (ssh.Signer, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.signer == nil && s.err == nil {
+		s.signer, s.err = decryptPrivateKey(s.opts, s.keyFile, s.key)
+		if s.err != nil {
+			s.err = fmt.Errorf("%v: %v", s.keyFile, s.err)
+		}
+	}
+	return s.signer, s.err
+}
+
+// agentSigner returns the agent signer for a public key or nil if
+// the agent does not have the key. The key file is not used for
+// the keys in the agent so that the passphrase is not asked for.
+func agentSigner(opts options, pub ssh.PublicKey) ssh.Signer {
+	if opts.SSHAgent == false {
+		return nil
+	}
+	for _, s := range opts.AgentSigners {
+		if bytes.Equal(s.PublicKey().Marshal(), pub.Marshal()) {
+			return s
+		}
+	}
+	return nil
+}
+
+// homeDir returns the home directory of the invoking user.
+func homeDir() string {
+	u, err := user.Current()
+	check(err)
+	return u.HomeDir
+}
+
+// expandHome replaces a leading ~/ with the home directory of
+// the invoking user.
+func expandHome(fn string) string {
+	if strings.HasPrefix(fn, "~/") {
+		return path.Join(homeDir(), fn[2:])
+	}
+	return fn
+}
+
+// identityFiles returns the private key files to try for a host
+// in order: the host file identities, the -i identities and, if
+// neither was specified, the standard ssh identities. The
+// --scan-keys option adds the rest of the ~/.ssh/id_* files.
+// The keys always come from the invoking user, the remote user
+// may not exist locally.
+func identityFiles(hi hostinfo, opts options) (files []string) {
+	files = append(files, hi.IdentityFiles...)
+	files = append(files, opts.IdentityFiles...)
+
+	sshDir := path.Join(homeDir(), ".ssh")
+	if len(files) == 0 {
+		for _, fn := range []string{"id_rsa", "id_ecdsa", "id_ecdsa_sk", "id_ed25519", "id_ed25519_sk"} {
+			keyFile := path.Join(sshDir, fn)
+			if _, err := os.Stat(keyFile); err == nil {
+				files = append(files, keyFile)
+			}
+		}
+	}
+
+	if opts.ScanKeys {
+		// Look for id_ files that do not have the .pub extension.
+		seen := map[string]bool{}
+		for _, keyFile := range files {
+			seen[keyFile] = true
+		}
+		entries, _ := ioutil.ReadDir(sshDir)
+		for _, f := range entries {
+			fn := f.Name()
+			keyFile := path.Join(sshDir, fn)
+			if strings.HasPrefix(fn, "id_") && strings.HasSuffix(fn, ".pub") == false {
+				if seen[keyFile] == false {
+					files = append(files, keyFile)
+				}
+			} else {
+				vinfon(opts, 2, "      ignoring %v", fn)
+			}
+		}
+	}
+	return
+}
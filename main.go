@@ -27,15 +27,20 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
+	"net"
 	"os"
-	"os/user"
-	"path"
 	"runtime"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/ssh"
@@ -49,7 +54,32 @@ import (
 //var version = "0.6" // Add support for max jobs
 //var version = "0.7" // Add support for timeout
 //var version = "0.8" // Add retries for the TCP dial operation
-var version = "0.8.1" // Fix error recovery in goroutine
+//var version = "0.8.1" // Fix error recovery in goroutine
+//var version = "0.9" // Verify host keys against known_hosts
+//var version = "0.10" // Add --host-key-policy and the sshx known_hosts store
+//var version = "0.11" // Add host key fingerprint pinning to host specs
+//var version = "0.12" // Add host and user certificate support
+//var version = "0.13" // Add ssh-agent authentication
+//var version = "0.14" // Add support for passphrase protected keys
+//var version = "0.15" // Add -i and per host identity files
+//var version = "0.16" // Handle multi-prompt keyboard-interactive challenges
+//var version = "0.17" // Prompt for the password once per run
+//var version = "0.18" // Add password env, command and map sources
+//var version = "0.19" // Add the encrypted vault
+//var version = "0.20" // Report the remote exit status
+//var version = "0.21" // Capture stdout and stderr concurrently
+//var version = "0.22" // Add the --stream output mode
+//var version = "0.23" // Add the --collate output mode
+//var version = "0.24" // Add the json and ndjson output formats
+//var version = "0.25" // Add the --outdir results directory
+//var version = "0.26" // Add the end of run summary
+//var version = "0.27" // Run the jobs in a worker pool
+//var version = "0.28" // Add the per host command and connect timeouts
+//var version = "0.29" // Stop the jobs gracefully on ^C
+//var version = "0.30" // Add the kill signal and grace period
+//var version = "0.31" // Retry with exponential backoff
+//var version = "0.32" // Add the handshake timeout
+var version = "0.33" // Add the ssh keepalives
 
 func main() {
 	// This is a hard-coded test of SSH.
@@ -58,42 +88,49 @@ func main() {
 		os.Exit(0)
 	}
 
-	// Setup a goroutine to timeout if the user requested it.
-	if opts.TimeoutSecs > 0 {
-		go func(s int) {
-			time.Sleep(time.Duration(s) * time.Second)
-			fatal("timed out after %v seconds", s)
-			os.Exit(1)
-		}(opts.TimeoutSecs)
-	}
-
 	// Check for the case of no-command, that implies a remote terminal for
 	// a single host.
 	if len(opts.Command) == 0 {
 		if len(opts.Hosts) == 1 {
+			// Setup a goroutine to timeout if the user requested it.
+			// The commands stop gracefully instead, see
+			// execCmdsInParallel.
+			if opts.TimeoutSecs > 0 {
+				go func(s int) {
+					time.Sleep(time.Duration(s) * time.Second)
+					fatal("timed out after %v seconds", s)
+					os.Exit(1)
+				}(opts.TimeoutSecs)
+			}
 			loadSSHConfig(opts)
-			execTerm(opts)
+			os.Exit(execTerm(opts))
 		} else {
 			fatal("cannot spawn remote shells on multiple hosts")
 		}
 	} else {
-		execCmdsInParallel(opts)
+		os.Exit(execCmdsInParallel(opts))
 	}
 }
 
 // load SSH configuration data.
 func loadSSHConfig(opts options) {
+	vinfo(opts, "loading known hosts")
+	opts.HostKeys = newHostKeyChecker(opts)
+	if opts.SSHAgent {
+		vinfo(opts, "loading agent keys")
+		opts.AgentSigners = agentSigners(opts)
+	}
 	for i, hi := range opts.Hosts {
-		opts.Hosts[i].Config = sshClientConfig(hi, opts)
+		opts.Hosts[i].Config, opts.Hosts[i].Auth = sshClientConfig(hi, opts)
 	}
 }
 
 // prompt
 func prompt(p string, d string) (value string) {
 	if d == "" {
-		fmt.Print(p + ": ")
+		fmt.Fprint(promptWriter, p+": ")
 	} else {
-		fmt.Printf("%v <%v>: ", p, d)
+		fmt.Fprintf(promptWriter, "%v <%v>: ", p, d)
 	}
 	r := bufio.NewReader(os.Stdin)
 	value, _ = r.ReadString('\n')
@@ -104,73 +141,132 @@ func prompt(p string, d string) (value string) {
 	return
 }
 
+// promptPassword prompts for the password of a host that does not
+// have one. The answer is cached for the --password-scope so that
+// the user is only asked once for the whole run by default.
+func promptPassword(hi hostinfo, opts options) string {
+	key := ""
+	p := "password for all hosts: "
+	switch opts.PasswordScope {
+	case "domain":
+		key = hi.Username + "@" + hostDomain(hi.Host)
+		p = fmt.Sprintf("%v's password: ", key)
+	case "host":
+		key = hi.Username + "@" + hi.Host
+		p = fmt.Sprintf("%v's password: ", key)
+	}
+	if password, found := opts.PasswordCache[key]; found {
+		return password
+	}
+	password := getPassword(p)
+	opts.PasswordCache[key] = password
+	return password
+}
+
+// hostDomain returns the domain of a host by removing the port and
+// the first label: web1.prod.example.com:22 is prod.example.com.
+// IP addresses and single label names are returned as is.
+func hostDomain(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if net.ParseIP(host) != nil {
+		return host
+	}
+	if pos := strings.Index(host, "."); pos >= 0 {
+		return host[pos+1:]
+	}
+	return host
+}
+
 // Create the ssh config structure for:
+//    agent
 //    password
 //    keyboard-interactive
 //    publickey
-func sshClientConfig(hi hostinfo, opts options) (config *ssh.ClientConfig) {
+// The auth methods for each connection are created by the auth
+// function, the config does not have them.
+func sshClientConfig(hi hostinfo, opts options) (config *ssh.ClientConfig, auth func() []ssh.AuthMethod) {
 	vinfo(opts, "configuring ssh for [%v] %v@%v", hi.ID, hi.Username, hi.Host)
 
 	username := hi.Username
 	password := hi.Password
 	host := hi.Host
 
-	// Get the user's password.
+	// Get the user's password if it was not specified for the host.
 	if opts.SSHPassword || opts.SSHKeyboardInteractive {
-		if len(opts.Password) == 0 {
-			password = getPassword(fmt.Sprintf("%v@%v's password: ", username, host))
-		} else {
-			password = opts.Password
+		if len(password) == 0 {
+			password = promptPassword(hi, opts)
 		}
 	}
 
 	config = &ssh.ClientConfig{
-		User: username,
+		User:            username,
+		HostKeyCallback: opts.HostKeys.check,
+		Timeout:         time.Duration(opts.ConnectTimeoutSecs) * time.Second,
+	}
+
+	// A pinned fingerprint replaces the known_hosts check.
+	if len(hi.HostKey) > 0 {
+		vinfo(opts, "   pinned host key: %v", hi.HostKey)
+		config.HostKeyCallback = pinned(hi.HostKey)
 	}
 
 	// Use a custom set of host key algorithms if the user specified it.
+	// Otherwise prefer the key types that are already known for the
+	// host so that they can be verified.
 	if len(opts.HostKeyAlgorithms) > 0 {
 		as := strings.Join(opts.HostKeyAlgorithms, ",")
 		vinfo(opts, "   updating host key algorithms: [ %v ]", as)
 		config.HostKeyAlgorithms = opts.HostKeyAlgorithms
+	} else if len(hi.HostKey) > 0 {
+		config.HostKeyAlgorithms = plainHostKeyAlgorithms()
+	} else if algs := opts.HostKeys.algorithms(host); len(algs) > 0 {
+		vinfon(opts, 2, "   known host key algorithms: [ %v ]", strings.Join(algs, ","))
+		config.HostKeyAlgorithms = algs
+	}
+
+	// auth: agent
+	// The agent keys are tried before the key files, like ssh does.
+	signers := []ssh.Signer{}
+	if opts.SSHAgent {
+		vinfo(opts, "   auth: agent")
+		signers = append(signers, opts.AgentSigners...)
 	}
 
 	// auth: public-key
-	// Get the public key, if it is available.
+	// Get the private keys, if they are available.
 	if opts.SSHPublicKey {
 		vinfo(opts, "   auth: public-key")
-		if userData, err1 := user.Lookup(username); err1 == nil {
-			sshDir := path.Join(userData.HomeDir, ".ssh")
-			if _, err2 := os.Stat(sshDir); err2 == nil {
-				// The ~/.ssh directory exists look for id_ files that do
-				// do not have the .pub extension. Add an auth entry for
-				// each one.
-				// Typically they will be things like id_rsa or id_ecdsa.
-				files, _ := ioutil.ReadDir(sshDir)
-				for _, f := range files {
-					fn := f.Name()
-					if strings.HasPrefix(fn, "id_") && strings.HasSuffix(fn, ".pub") == false {
-						keyFile := path.Join(sshDir, fn)
-						vinfo(opts, "      keyFile = %v", keyFile)
-						if key, err3 := ioutil.ReadFile(keyFile); err3 == nil {
-							if signer, err4 := ssh.ParsePrivateKey(key); err4 == nil {
-								config.Auth = append(config.Auth, ssh.PublicKeys(signer))
-							} else {
-								vinfo(opts, "         %v", err4)
-							}
-						} else {
-							vinfo(opts, "         %v", err3)
-						}
-					} else {
-						vinfon(opts, 2, "      ignoring %v", fn)
-					}
-				} // for loop
+		for _, keyFile := range identityFiles(hi, opts) {
+			vinfo(opts, "      keyFile = %v", keyFile)
+			if signer, err := privateKeySigner(opts, keyFile); err == nil {
+				// The agent signs for the keys that it has, they
+				// were already added above.
+				as := agentSigner(opts, signer.PublicKey())
+				if as != nil {
+					vinfo(opts, "         the key is in the agent")
+					signer = as
+				}
+				// Present the certificate first, if there is one.
+				if cs := certSigner(opts, username, keyFile, signer); cs != nil {
+					signers = append(signers, cs)
+				}
+				if as == nil {
+					signers = append(signers, signer)
+				}
 			} else {
-				vinfo(opts, "   %v", err1)
+				vinfo(opts, "         %v", err)
 			}
 		}
 	}
 
+	// All of the keys must be in a single auth method because
+	// the ssh package only tries each method once.
+	if len(signers) > 0 {
+		config.Auth = append(config.Auth, ssh.PublicKeys(signers...))
+	}
+
 	// auth: password
 	if opts.SSHPassword {
 		vinfo(opts, "   auth: password")
@@ -178,101 +274,318 @@ func sshClientConfig(hi hostinfo, opts options) (config *ssh.ClientConfig) {
 	}
 
 	// auth: keyboard-interactive
+	// A new method is created for each connection because it
+	// remembers whether it answered the password prompt.
+	methods := config.Auth
+	config.Auth = nil
+	auth = func() []ssh.AuthMethod { return methods }
 	if opts.SSHKeyboardInteractive {
 		vinfo(opts, "   auth: keyboard-interactive")
+		auth = func() []ssh.AuthMethod {
+			return append(append([]ssh.AuthMethod{}, methods...), keyboardInteractive(username, host, password))
+		}
+	}
+	return
+}
 
-		// This will be called if SSH keyboard-interactive is enabled and
-		// password is disabled. Same as:
-		//    ssh -o PreferredAuthentications=password,keyboard-interactive
-		// See RFC-4252 for details of how the callbacks work.
-		kbic := func(
-			user,
-			instruction string,
-			questions []string,
-			echos []bool) (answers []string, err error) {
-			// Callback, will be called multiple times.
-			if len(questions) == 0 {
-				return []string{}, nil
+// keyboardInteractive returns the keyboard-interactive auth method
+// for a connection. It is the same as:
+//    ssh -o PreferredAuthentications=password,keyboard-interactive
+// See RFC-4256 for details of how the callbacks work.
+//
+// The first prompt that asks for a password is answered with the
+// known password. Everything else, like a one time password or a
+// verification code, is asked of the user with the echo setting
+// that the server requested.
+func keyboardInteractive(username string, host string, password string) ssh.AuthMethod {
+	usedPassword := false
+	kbic := func(
+		name,
+		instruction string,
+		questions []string,
+		echos []bool) (answers []string, err error) {
+		// Callback, will be called multiple times.
+		header := true
+		for i, q := range questions {
+			if echos[i] == false && usedPassword == false && len(password) > 0 && isPasswordPrompt(q) {
+				usedPassword = true
+				answers = append(answers, password)
+				continue
 			}
-			if len(questions) == 1 {
-				return []string{password}, nil
+
+			// The hosts authenticate concurrently so only one of them
+			// can talk to the user at a time.
+			if header {
+				header = false
+				promptMutex.Lock()
+				defer promptMutex.Unlock()
+				fmt.Fprintf(promptWriter, "%v@%v\n", username, host)
+				for _, s := range []string{name, instruction} {
+					if s = strings.TrimSpace(s); len(s) > 0 {
+						fmt.Fprintln(promptWriter, s)
+					}
+				}
+			}
+			if echos[i] {
+				answers = append(answers, prompt(strings.TrimRight(q, ": "), ""))
+			} else {
+				answers = append(answers, getPassword(q))
 			}
-			panic(fmt.Errorf("ERROR: unexpected authentication chain"))
 		}
+		return
+	}
+	return ssh.KeyboardInteractive(kbic)
+}
 
-		config.Auth = append(config.Auth, ssh.KeyboardInteractive(kbic))
+// isPasswordPrompt reports whether a keyboard-interactive question
+// asks for the account password rather than something like a one
+// time password.
+func isPasswordPrompt(q string) bool {
+	q = strings.ToLower(q)
+	return strings.Contains(q, "password") && strings.Contains(q, "new") == false
+}
+
+// certSigner returns a signer that presents the OpenSSH user
+// certificate in <keyFile>-cert.pub for the private key. Nil is
+// returned if there is no certificate or if the server would
+// reject it anyway.
+func certSigner(opts options, username string, keyFile string, signer ssh.Signer) ssh.Signer {
+	certFile := keyFile + "-cert.pub"
+	data, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil
+	}
+	vinfo(opts, "      certFile = %v", certFile)
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		vinfo(opts, "         %v", err)
+		return nil
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok || cert.CertType != ssh.UserCert {
+		vinfo(opts, "         not a user certificate")
+		return nil
+	}
+	if bytes.Equal(cert.Key.Marshal(), signer.PublicKey().Marshal()) == false {
+		vinfo(opts, "         certificate is not for %v", keyFile)
+		return nil
 	}
 
-	return
+	// Check the validity window. The principals are not checked,
+	// the server decides which principals can log in as which
+	// user, for example with AuthorizedPrincipalsFile.
+	now := uint64(time.Now().Unix())
+	if now < cert.ValidAfter {
+		vinfo(opts, "         certificate is not valid yet")
+		return nil
+	}
+	if cert.ValidBefore != ssh.CertTimeInfinity && now >= cert.ValidBefore {
+		vinfo(opts, "         certificate has expired")
+		return nil
+	}
+	vinfon(opts, 2, "         principals %v for %v", cert.ValidPrincipals, username)
+
+	cs, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		vinfo(opts, "         %v", err)
+		return nil
+	}
+	return cs
 }
 
 // Execute the commands in parallel.
-func execCmdsInParallel(opts options) {
+// The exit status is the highest exit status of the remote
+// commands or 255 if any host did not report one.
+func execCmdsInParallel(opts options) (status int) {
 	loadSSHConfig(opts)
+	start := time.Now()
 
-	hiChan := make(chan hostinfo, opts.MaxParallelJobs)
+	// The global timeout or ^C stops the jobs that are still running
+	// and the ones that have not started yet. The results collected
+	// so far are still reported.
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if opts.TimeoutSecs > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), time.Duration(opts.TimeoutSecs)*time.Second)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	defer cancel()
+	interruptCancel(cancel)
+	defer interruptCancel(nil)
+
+	if opts.Stream {
+		opts.Streamer = newStreamPrinter(opts)
+	}
+	var rd *resultsDir
+	if len(opts.OutDir) > 0 {
+		rd = newResultsDir(opts)
+	}
 
-	// lambda that acts at the channel sink
-	sink := func(m int, c chan hostinfo) {
-		for i := 0; i < m; i++ {
-			hi := <-c
-			if opts.JobHeader {
-				fmt.Printf(`
+	// lambda that reports a finished job
+	results := []hostinfo{}
+	report := func(hi hostinfo) {
+		stdout, stderr := formatOutput(hi, opts.StderrMode)
+		if rd != nil {
+			rd.write(hi, opts)
+		}
+		results = append(results, hi)
+		if opts.Collate || opts.OutputFormat == "json" {
+			// Printed when all of the jobs are done.
+		} else if opts.OutputFormat == "ndjson" {
+			printJSON(newJSONResult(hi, opts), false)
+		} else if opts.Stream {
+			// The output was printed as it arrived.
+			opts.Streamer.print(hi, outputLine{Stream: "sshx", Text: "# Exit : " + exitString(hi)})
+		} else if opts.JobHeader {
+			fmt.Printf(`
 # ================================================================
 # Job  : %[1]v
 # User : %[2]v
 # Host : %[3]v
 # Cmd  : %[4]v
 # Size : %[5]v
+# Exit : %[6]v
 # ================================================================
-%[6]v
-`, hi.ID, hi.Username, hi.Host, opts.Command, len(hi.Output), hi.Output)
-			} else {
-				fmt.Print(hi.Output)
-			}
+%[7]v
+`, hi.ID, hi.Username, hi.Host, opts.Command, len(stdout), exitString(hi), stdout)
+		} else {
+			fmt.Print(stdout)
+		}
+		if opts.Stream == false && opts.Collate == false && opts.OutputFormat == "text" {
+			fmt.Fprint(os.Stderr, stderr)
+		}
+		if hi.ExitStatus < 0 {
+			status = 255
+		} else if hi.ExitStatus > status {
+			status = hi.ExitStatus
 		}
 	}
 
-	// Spawn the commands in parallel.
-	// Honor the max parallel jobs setting.
-	for j, hi := range opts.Hosts {
-		vinfon(opts, 2, "spawning job %v", j)
-		go execCmd(hi, opts, hiChan) // source
-		if opts.MaxParallelJobs < 2 {
-			vinfon(opts, 2, "sinking 1 job")
-			sink(1, hiChan)
-		} else {
-			if j > 0 && (j%opts.MaxParallelJobs) == 0 {
-				vinfon(opts, 2, "sinking %v jobs", opts.MaxParallelJobs)
-				sink(opts.MaxParallelJobs, hiChan)
+	// Run the jobs in a pool of MaxParallelJobs workers. A worker
+	// starts the next host as soon as its job is done so there are
+	// never more than MaxParallelJobs connections open at once.
+	workers := opts.MaxParallelJobs
+	if workers < 1 {
+		workers = 1
+	}
+	jobs := make(chan hostinfo)
+	hiChan := make(chan hostinfo)
+	for w := 0; w < workers; w++ {
+		go func() {
+			for hi := range jobs {
+				execCmd(ctx, hi, opts, hiChan) // source
+			}
+		}()
+	}
+	go func() {
+		for j, hi := range opts.Hosts {
+			vinfon(opts, 2, "spawning job %v", j)
+			jobs <- hi
+		}
+		close(jobs)
+	}()
+
+	// Report the jobs as they complete or in the order of the hosts.
+	// In order, a finished job is held until the jobs before it are
+	// reported.
+	pending := map[int]hostinfo{}
+	next := 0
+	for n := 0; n < len(opts.Hosts); n++ {
+		hi := <-hiChan
+		if opts.OutputOrder == "completed" {
+			report(hi)
+			continue
+		}
+		pending[hi.ID] = hi
+		for next < len(opts.Hosts) {
+			hi, found := pending[opts.Hosts[next].ID]
+			if !found {
+				break
 			}
+			delete(pending, hi.ID)
+			report(hi)
+			next++
 		}
 	}
 
-	// Catch any left overs.
-	if opts.MaxParallelJobs > 1 {
-		unsunk := len(opts.Hosts) % opts.MaxParallelJobs
-		if unsunk == 0 {
-			unsunk = opts.MaxParallelJobs
+	sort.Slice(results, func(i, j int) bool { return results[i].ID < results[j].ID })
+	if opts.Collate {
+		collate(results, opts)
+	} else if opts.OutputFormat == "json" {
+		records := []jsonResult{}
+		for _, hi := range results {
+			records = append(records, newJSONResult(hi, opts))
 		}
-		vinfon(opts, 2, "checking for remaining unsunk channel elements %v", unsunk)
-		if unsunk > 0 {
-			vinfon(opts, 2, "final unsunk = %v", unsunk)
-			sink(unsunk, hiChan)
+		printJSON(records, true)
+	}
+	if opts.Summary {
+		printSummary(results, time.Since(start))
+	}
+	if status > 255 {
+		status = 255
+	}
+	return
+}
+
+// exitString describes how the remote command finished for the
+// job header.
+func exitString(hi hostinfo) string {
+	if hi.ExitStatus < 0 {
+		if len(hi.ExitSignal) > 0 {
+			return fmt.Sprintf("none (signal %v)", hi.ExitSignal)
 		}
+		return "none"
 	}
+	if len(hi.ExitSignal) > 0 {
+		return fmt.Sprintf("%v (signal %v)", hi.ExitStatus, hi.ExitSignal)
+	}
+	return fmt.Sprintf("%v", hi.ExitStatus)
+}
+
+// setExitStatus records the exit status from session.Wait.
+// It returns the error if the command did not finish.
+func setExitStatus(hi *hostinfo, err error) error {
+	switch e := err.(type) {
+	case nil:
+		hi.ExitStatus = 0
+	case *ssh.ExitError:
+		hi.ExitStatus = e.ExitStatus()
+		hi.ExitSignal = e.Signal()
+	case *ssh.ExitMissingError:
+		hi.ExitStatus = -1
+	default:
+		hi.ExitStatus = -1
+		return err
+	}
+	return nil
 }
 
 // Execute the command for all hosts.
-func execCmd(hi hostinfo, opts options, hiChan chan hostinfo) {
+func execCmd(ctx context.Context, hi hostinfo, opts options, hiChan chan hostinfo) {
 	// lambda for handling goroutine errors
+	started := false
+	connected := false
 	cx := func(err error) bool {
 		if err != nil {
+			if ctx.Err() != nil {
+				// The error is a side effect of stopping the job.
+				err = stoppedError(ctx.Err(), opts, started)
+			}
+			hi.ExitStatus = -1
+			hi.Status = failureStatus(err, connected)
+			hi.Error = err.Error()
+			hi.End = time.Now()
 			if len(hi.Output) > 0 && hi.Output[len(hi.Output)-1] != '\n' {
 				hi.Output += "\n"
 			}
 			_, _, lineno, _ := runtime.Caller(1)
-			hi.Output += fmt.Sprintf("ERROR:%v %v %v@%v - %v\n", lineno, hi.ID, hi.Username, hi.Host, err)
+			msg := fmt.Sprintf("ERROR:%v %v %v@%v - %v", lineno, hi.ID, hi.Username, hi.Host, err)
+			hi.Output += msg + "\n"
+			hi.Lines = append(hi.Lines, outputLine{Stream: "sshx", Text: msg})
+			if opts.Stream {
+				opts.Streamer.print(hi, outputLine{Stream: "sshx", Text: msg})
+			}
 			hiChan <- hi
 			return true
 		}
@@ -287,11 +600,20 @@ func execCmd(hi hostinfo, opts options, hiChan chan hostinfo) {
 		return
 	}
 
+	// The run was stopped before this job started.
+	if cx(ctx.Err()) {
+		return
+	}
+
 	// Create the connection.
-	conn, err := tcpConnect(opts, hi)
+	started = true
+	hi.Start = time.Now()
+	conn, err := tcpConnect(ctx, opts, &hi)
 	if cx(err) {
 		return
 	}
+	defer conn.Close()
+	connected = true
 	session, err := conn.NewSession()
 	if cx(err) {
 		return
@@ -299,10 +621,9 @@ func execCmd(hi hostinfo, opts options, hiChan chan hostinfo) {
 	defer session.Close()
 
 	// Collect the output from stdout and stderr.
-	// The idea is to duplicate the shell IO redirection
-	// comment 2>&1 where both streams are interleaved but
-	// that doesn't work because each stream is handled
-	// independently.
+	// Both streams are read at the same time so that the lines are
+	// captured in the order that they arrive and so that the remote
+	// side never blocks because nobody is reading stderr.
 	stdoutPipe, err := session.StdoutPipe()
 	if cx(err) {
 		return
@@ -311,8 +632,6 @@ func execCmd(hi hostinfo, opts options, hiChan chan hostinfo) {
 	if cx(err) {
 		return
 	}
-	outputReader := io.MultiReader(stdoutPipe, stderrPipe)
-	outputScanner := bufio.NewScanner(outputReader)
 
 	// Start the session.
 	err = session.Start(opts.Command)
@@ -320,45 +639,127 @@ func execCmd(hi hostinfo, opts options, hiChan chan hostinfo) {
 		return
 	}
 
-	// Capture the output asynchronously.
-	outputLine := make(chan string)
-	outputDone := make(chan bool)
-	go func(scan *bufio.Scanner, line chan string, done chan bool) {
-		defer close(line)
-		defer close(done)
-		for scan.Scan() {
-			line <- scan.Text()
+	// lambda that stops the remote command
+	// The command is sent the kill signal so that it is not left
+	// running on the host and then it has the grace period to exit
+	// before the connection is closed. Closing the connection ends
+	// the output and the wait below.
+	stop := func(why string) {
+		vinfo(opts, "%v, sending %v to [%v] %v@%v", why, opts.KillSignal, hi.ID, hi.Username, hi.Host)
+		if err := session.Signal(opts.KillSignal); err != nil {
+			vinfo(opts, "   %v", err)
 		}
-		done <- true
-	}(outputScanner, outputLine, outputDone)
+		time.AfterFunc(time.Duration(opts.KillGraceSecs)*time.Second, func() {
+			conn.Close()
+		})
+	}
 
-	// Use a custom wait.
-	outputBuf := ""
-	running := true
-	for running {
+	// Stop the command if it runs too long.
+	var timer *time.Timer
+	if opts.CommandTimeoutSecs > 0 {
+		timer = time.AfterFunc(time.Duration(opts.CommandTimeoutSecs)*time.Second, func() {
+			stop("command timed out")
+		})
+	}
+
+	// Stop the command if the run is stopped.
+	// The command may exit on the kill signal or even trap it and
+	// exit 0 so stopped records that the run stopped it.
+	finished := make(chan bool)
+	defer close(finished)
+	stopped := make(chan bool, 1)
+	go func() {
 		select {
-		case <-outputDone:
-			running = false
-		case line := <-outputLine:
-			outputBuf += line + "\n"
+		case <-ctx.Done():
+			stopped <- true
+			stop("run stopped")
+		case <-finished:
 		}
+	}()
+
+	// Detect a dead connection.
+	lost := make(chan bool, 1)
+	if opts.KeepaliveIntervalSecs > 0 {
+		go keepalive(conn, opts, hi, finished, lost)
 	}
 
+	// Capture the output asynchronously.
+	lines := make(chan outputLine)
+	readers := sync.WaitGroup{}
+	readers.Add(2)
+	go readLines("stdout", stdoutPipe, lines, &readers)
+	go readLines("stderr", stderrPipe, lines, &readers)
+	go func() {
+		readers.Wait()
+		close(lines)
+	}()
+
+	outputBuf := ""
+	for line := range lines {
+		if opts.Stream {
+			opts.Streamer.print(hi, line)
+		}
+		hi.Lines = append(hi.Lines, line)
+		outputBuf += line.Text + "\n"
+	}
+
+	// Wait for the remote command to exit to get its status.
 	hi.Output = outputBuf
+	err = setExitStatus(&hi, session.Wait())
+	if timer != nil && timer.Stop() == false {
+		err = timeoutError{what: "command", after: time.Duration(opts.CommandTimeoutSecs) * time.Second}
+	} else if len(lost) > 0 {
+		err = connectionLostError{missed: opts.KeepaliveCount, interval: time.Duration(opts.KeepaliveIntervalSecs) * time.Second}
+	} else if len(stopped) > 0 {
+		err = ctx.Err()
+	}
+	if cx(err) {
+		return
+	}
+	hi.End = time.Now()
+	hi.Status = "succeeded"
+	if hi.ExitStatus != 0 {
+		hi.Status = "failed"
+	}
 	hiChan <- hi
 }
 
+// readLines reads the lines of a remote stream, tags them with
+// the stream name and sends them to the lines channel.
+func readLines(stream string, r io.Reader, lines chan outputLine, readers *sync.WaitGroup) {
+	defer readers.Done()
+	br := bufio.NewReader(r)
+	for {
+		text, err := br.ReadString('\n')
+		if len(text) > 0 {
+			lines <- outputLine{Stream: stream, Text: strings.TrimSuffix(text, "\n")}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
 // Execute an interactive terminal.
 // This only works for a single user.
-func execTerm(opts options) {
+// The exit status is the exit status of the remote shell.
+func execTerm(opts options) int {
 	vinfo(opts, "creating interactive terminal")
 
-	conn, err := tcpConnect(opts, opts.Hosts[0])
+	hi := opts.Hosts[0]
+	conn, err := tcpConnect(context.Background(), opts, &hi)
 	check(err)
 	session, err := conn.NewSession()
 	check(err)
 	defer session.Close()
 
+	finished := make(chan bool)
+	defer close(finished)
+	lost := make(chan bool, 1)
+	if opts.KeepaliveIntervalSecs > 0 {
+		go keepalive(conn, opts, hi, finished, lost)
+	}
+
 	// Use the current terminal fds.
 	session.Stdin = os.Stdin
 	session.Stdout = os.Stdout
@@ -374,23 +775,167 @@ func execTerm(opts options) {
 	err = session.Shell()
 	check(err)
 	vinfo(opts, "remote shell started")
-	err = session.Wait()
+	err = setExitStatus(&hi, session.Wait())
+	if len(lost) > 0 {
+		err = connectionLostError{missed: opts.KeepaliveCount, interval: time.Duration(opts.KeepaliveIntervalSecs) * time.Second}
+	}
 	check(err)
-	vinfo(opts, "remote shell finished")
+	vinfo(opts, "remote shell finished: %v", exitString(hi))
+	if hi.ExitStatus < 0 || hi.ExitStatus > 255 {
+		return 255
+	}
+	return hi.ExitStatus
 }
 
 // tcpConnect
-func tcpConnect(opts options, hi hostinfo) (*ssh.Client, error) {
-	conn, err := ssh.Dial("tcp", hi.Host, hi.Config)
-	for r := 0; r < opts.NumRetries; r++ {
-		if err == nil {
-			break
+func tcpConnect(ctx context.Context, opts options, hi *hostinfo) (*ssh.Client, error) {
+	delay := time.Duration(opts.RetryDelayMsecs) * time.Millisecond
+	maxDelay := time.Duration(opts.RetryMaxDelayMsecs) * time.Millisecond
+	deadline := time.Now().Add(time.Duration(opts.RetryTimeSecs) * time.Second)
+	for {
+		hi.Attempts++
+		conn, err := dial(ctx, opts, hi)
+		if err == nil || ctx.Err() != nil || hi.Attempts > opts.NumRetries {
+			return conn, err
+		}
+		if retryable(err) == false {
+			vinfon(opts, 2, "not retrying %v %v@%v: %v", hi.ID, hi.Username, hi.Host, err)
+			return conn, err
+		}
+
+		// Exponential backoff with jitter so that the hosts that
+		// failed together do not retry together.
+		// A retry is not started if its connect timeout could run
+		// past the retry time.
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		if opts.RetryTimeSecs > 0 && time.Now().Add(wait+hi.Config.Timeout).After(deadline) {
+			vinfon(opts, 2, "retry time exceeded %v %v@%v", hi.ID, hi.Username, hi.Host)
+			return conn, err
+		}
+		vinfon(opts, 2, "retry %v in %v %v %v@%v: %v", hi.Attempts, wait, hi.ID, hi.Username, hi.Host, err)
+		select {
+		case <-ctx.Done():
+			return conn, err
+		case <-time.After(wait):
+		}
+		delay *= 2
+		if delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+}
+
+// keepalive sends keepalive@openssh.com requests on the connection
+// every interval. If the server does not reply to count requests in
+// a row the connection is dead, it is closed to end the command and
+// lost is notified. It runs until done is closed.
+func keepalive(conn *ssh.Client, opts options, hi hostinfo, done chan bool, lost chan bool) {
+	interval := time.Duration(opts.KeepaliveIntervalSecs) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	missed := 0
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		// The reply is usually a failure because the request is not
+		// known, any reply shows that the server is alive.
+		reply := make(chan error, 1)
+		go func() {
+			_, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+		select {
+		case <-done:
+			return
+		case err := <-reply:
+			if err != nil {
+				return // the connection is already closed
+			}
+			missed = 0
+		case <-time.After(interval):
+			missed++
+			vinfon(opts, 2, "no keepalive reply %v of %v from [%v] %v@%v", missed, opts.KeepaliveCount, hi.ID, hi.Username, hi.Host)
+			if missed >= opts.KeepaliveCount {
+				vinfo(opts, "connection to [%v] %v@%v is dead", hi.ID, hi.Username, hi.Host)
+				lost <- true
+				conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// retryable reports whether a connection error is transient.
+// Network errors are retried, like refused connections or a server
+// that drops the connection during the handshake because it is
+// busy. Authentication and host key errors are not, they fail the
+// same way every time.
+// Connect timeouts are retried, the retry time limits how long a
+// host that does not answer is tried. Handshake timeouts are not
+// retried because the server answered and because the handshake
+// may include keyboard-interactive prompts that the user would be
+// asked again.
+func retryable(err error) bool {
+	var te timeoutError
+	if errors.As(err, &te) {
+		return te.what == "connect"
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsNotFound == false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// dial connects to the host. It is ssh.Dial except that the
+// connection is closed if the context is done during the
+// handshake. After that execCmd stops the command.
+// The TCP connection and the handshake have separate timeouts so
+// that a host that does not answer can be told apart from one that
+// is stuck in the key exchange or authentication.
+func dial(ctx context.Context, opts options, hi *hostinfo) (*ssh.Client, error) {
+	d := net.Dialer{Timeout: hi.Config.Timeout}
+	nc, err := d.DialContext(ctx, "tcp", hi.Host)
+	if err != nil {
+		if e, ok := err.(net.Error); ok && e.Timeout() && ctx.Err() == nil && d.Timeout > 0 {
+			return nil, timeoutError{what: "connect", after: d.Timeout}
+		}
+		return nil, err
+	}
+	handshakeTimeout := time.Duration(opts.HandshakeTimeoutSecs) * time.Second
+	if handshakeTimeout > 0 {
+		nc.SetDeadline(time.Now().Add(handshakeTimeout))
+	}
+	handshake := make(chan bool)
+	go func() {
+		select {
+		case <-ctx.Done():
+			nc.Close()
+		case <-handshake:
+		}
+	}()
+	config := *hi.Config
+	config.Auth = hi.Auth()
+	c, chans, reqs, err := ssh.NewClientConn(nc, hi.Host, &config)
+	close(handshake)
+	if err != nil {
+		nc.Close()
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() && ctx.Err() == nil && handshakeTimeout > 0 {
+			return nil, timeoutError{what: "handshake", after: handshakeTimeout}
 		}
-		vinfon(opts, 2, "retry %v %v %v@%v", r+1, hi.ID, hi.Username, hi.Host)
-		time.Sleep(time.Duration(200) * time.Millisecond)
-		conn, err = ssh.Dial("tcp", hi.Host, hi.Config)
+		return nil, err
 	}
-	return conn, err
+	nc.SetDeadline(time.Time{})
+	return ssh.NewClient(c, chans, reqs), nil
 }
 
 // Check for an error, if the error exists, repot it and exit.
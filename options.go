@@ -32,33 +32,89 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 )
 
+// outputLine is a line of output from a job tagged with the
+// stream that it came from: stdout, stderr or sshx for errors
+// reported by sshx itself.
+type outputLine struct {
+	Stream string
+	Text   string
+}
+
 type hostinfo struct {
-	Username string
-	Password string // per host password
-	Host     string // includes the port (e.g. localhost:22)
-	Config   *ssh.ClientConfig
-	HostFile string
-	ID       int
-	Output   string // filled in when the job is run
+	Username      string
+	Password      string   // per host password
+	Host          string   // includes the port (e.g. localhost:22)
+	HostKey       string   // pinned SHA256 host key fingerprint
+	IdentityFiles []string // private keys from the host file
+	Secret        string   // vault secret name from the host file
+	Config        *ssh.ClientConfig
+	Auth          func() []ssh.AuthMethod // new auth methods for each connection
+	HostFile      string
+	ID            int
+	Output        string // filled in when the job is run
+	Lines         []outputLine
+	ExitStatus    int    // remote exit status, -1 if there is none
+	ExitSignal    string // remote signal that killed the command
+	Start         time.Time
+	End           time.Time
+	Attempts      int    // connection attempts
+	Status        string // succeeded, failed, timeout, unreachable or cancelled
+	Error         string // why the job failed
 }
 
 type options struct {
 	Hosts                  []hostinfo
-	Password               string // default password
+	Password               string            // default password
+	Passphrase             string            // private key passphrase
+	PasswordScope          string            // run, domain or host
+	PasswordCache          map[string]string // prompted passwords by scope
+	PasswordMap            []passwordEntry
+	VaultFile              string
+	VaultPassphrase        string
 	Command                string
+	SSHAgent               bool
 	SSHKeyboardInteractive bool
 	SSHPassword            bool
 	SSHPublicKey           bool
 	HostKeyAlgorithms      []string
+	KnownHostsFiles        []string
+	KnownHostsStore        string
+	HostKeyPolicy          string
+	HostKeys               *hostKeyChecker
+	AgentSigners           []ssh.Signer
+	KeyCache               map[string]ssh.Signer // by private key file
+	IdentityFiles          []string
+	ScanKeys               bool
+	StderrMode             string // merge, tag, separate or local
+	Stream                 bool
+	Collate                bool
+	OutputFormat           string // text, json or ndjson
+	OutDir                 string
+	OutDirRun              bool // timestamped run directory
+	Summary                bool
+	OutputOrder            string // ordered or completed
+	Streamer               *streamPrinter
+	Color                  string // auto, always or never
 	Verbose                int
 	JobHeader              bool
 	MaxParallelJobs        int
 	TimeoutSecs            int
+	CommandTimeoutSecs     int
+	ConnectTimeoutSecs     int
+	HandshakeTimeoutSecs   int
+	KeepaliveIntervalSecs  int // 0 disables the keepalives
+	KeepaliveCount         int
+	KillSignal             ssh.Signal
+	KillGraceSecs          int
 	NumRetries             int
+	RetryDelayMsecs        int // the first retry delay
+	RetryMaxDelayMsecs     int
+	RetryTimeSecs          int // stop retrying after this, 0 for no limit
 }
 
 // getopts - gets the command line options and populations the options
@@ -93,9 +149,23 @@ func getopts() (opts options) {
 	}
 
 	opts.JobHeader = true
+	opts.StderrMode = "merge"
+	opts.Color = "auto"
+	opts.OutputFormat = "text"
+	opts.OutputOrder = "completed"
+	opts.KillSignal = ssh.SIGTERM
+	opts.KillGraceSecs = 2
+	opts.KeepaliveCount = 3
 	opts.MaxParallelJobs = -1
 	opts.NumRetries = 10
-	auth := "keyboard-interactive,password,public-key"
+	opts.RetryDelayMsecs = 200
+	opts.RetryMaxDelayMsecs = 2000
+	opts.HostKeyPolicy = "strict"
+	opts.KeyCache = map[string]ssh.Signer{}
+	opts.PasswordScope = "run"
+	opts.PasswordCache = map[string]string{}
+	opts.KnownHostsStore = defaultKnownHostsStore()
+	auth := "agent,keyboard-interactive,password,public-key"
 	i := 1
 	foundHosts := false
 	for ; i < len(os.Args) && foundHosts == false; i++ {
@@ -114,10 +184,55 @@ func getopts() (opts options) {
 			}
 		case "-h", "--help":
 			help()
+		case "--host-key-policy":
+			opts.HostKeyPolicy = strings.ToLower(nextArg(&i, opt))
+			switch opts.HostKeyPolicy {
+			case "strict", "accept-new", "off":
+			default:
+				log.Fatalf("ERROR: unrecognized host key policy '%v', valid policies: strict, accept-new, off", opts.HostKeyPolicy)
+			}
+		case "--handshake-timeout":
+			opts.HandshakeTimeoutSecs = nextArgInt(&i, opt, 0, 1000000)
+		case "--keepalive-count":
+			opts.KeepaliveCount = nextArgInt(&i, opt, 1, 1000000)
+		case "--keepalive-interval":
+			opts.KeepaliveIntervalSecs = nextArgInt(&i, opt, 0, 1000000)
+		case "--kill-grace":
+			opts.KillGraceSecs = nextArgInt(&i, opt, 0, 1000000)
+		case "--kill-signal":
+			opts.KillSignal = parseSignal(nextArg(&i, opt))
+		case "--known-hosts":
+			opts.KnownHostsFiles = append(opts.KnownHostsFiles, nextArg(&i, opt))
+		case "--known-hosts-store":
+			opts.KnownHostsStore = nextArg(&i, opt)
+		case "-i", "--identity":
+			keyFile := expandHome(nextArg(&i, opt))
+			if _, err := os.Stat(keyFile); err != nil {
+				log.Fatalf("ERROR: %v", err)
+			}
+			opts.IdentityFiles = append(opts.IdentityFiles, keyFile)
 		case "-j", "--max-jobs":
 			opts.MaxParallelJobs = nextArgInt(&i, opt, 0, 1000000)
 		case "-n", "--no-job-header":
 			opts.JobHeader = false
+		case "--order":
+			opts.OutputOrder = strings.ToLower(nextArg(&i, opt))
+			switch opts.OutputOrder {
+			case "ordered", "completed":
+			default:
+				log.Fatalf("ERROR: unrecognized order '%v', valid orders: ordered, completed", opts.OutputOrder)
+			}
+		case "--outdir":
+			opts.OutDir = nextArg(&i, opt)
+		case "--outdir-run":
+			opts.OutDirRun = true
+		case "--output":
+			opts.OutputFormat = strings.ToLower(nextArg(&i, opt))
+			switch opts.OutputFormat {
+			case "text", "json", "ndjson":
+			default:
+				log.Fatalf("ERROR: unrecognized output format '%v', valid formats: text, json, ndjson", opts.OutputFormat)
+			}
 		case "-p", "--password":
 			if len(opts.Password) != 0 {
 				warning("overwriting previous password setting")
@@ -129,14 +244,86 @@ func getopts() (opts options) {
 			}
 			pf := nextArg(&i, opt)
 			opts.Password = readPasswordFromFile(pf)
+		case "--password-command":
+			if len(opts.Password) != 0 {
+				warning("overwriting previous password setting")
+			}
+			opts.Password = readPasswordFromCommand(nextArg(&i, opt))
+		case "--password-env":
+			if len(opts.Password) != 0 {
+				warning("overwriting previous password setting")
+			}
+			opts.Password = readPasswordFromEnv(nextArg(&i, opt))
+		case "--password-map":
+			opts.PasswordMap = append(opts.PasswordMap, readPasswordMap(nextArg(&i, opt))...)
+		case "--password-scope":
+			opts.PasswordScope = strings.ToLower(nextArg(&i, opt))
+			switch opts.PasswordScope {
+			case "run", "domain", "host":
+			default:
+				log.Fatalf("ERROR: unrecognized password scope '%v', valid scopes: run, domain, host", opts.PasswordScope)
+			}
+		case "--passphrase-env":
+			if len(opts.Passphrase) != 0 {
+				warning("overwriting previous passphrase setting")
+			}
+			ev := nextArg(&i, opt)
+			opts.Passphrase = os.Getenv(ev)
+			if len(opts.Passphrase) == 0 {
+				log.Fatalf("ERROR: environment variable '%v' is not set or empty", ev)
+			}
+		case "--passphrase-file":
+			if len(opts.Passphrase) != 0 {
+				warning("overwriting previous passphrase setting")
+			}
+			pf := nextArg(&i, opt)
+			opts.Passphrase = readPasswordFromFile(pf)
 		case "-r", "--retries":
 			opts.NumRetries = nextArgInt(&i, opt, 0, 100)
+		case "--retry-delay":
+			opts.RetryDelayMsecs = nextArgInt(&i, opt, 1, 1000000)
+		case "--retry-max-delay":
+			opts.RetryMaxDelayMsecs = nextArgInt(&i, opt, 1, 1000000)
+		case "--retry-time":
+			opts.RetryTimeSecs = nextArgInt(&i, opt, 0, 1000000)
+		case "--scan-keys":
+			opts.ScanKeys = true
+		case "--collate":
+			opts.Collate = true
+		case "--command-timeout":
+			opts.CommandTimeoutSecs = nextArgInt(&i, opt, 0, 1000000)
+		case "--connect-timeout":
+			opts.ConnectTimeoutSecs = nextArgInt(&i, opt, 0, 1000000)
+		case "--color":
+			opts.Color = strings.ToLower(nextArg(&i, opt))
+			switch opts.Color {
+			case "auto", "always", "never":
+			default:
+				log.Fatalf("ERROR: unrecognized color mode '%v', valid modes: auto, always, never", opts.Color)
+			}
+		case "--stream":
+			opts.Stream = true
+		case "--stderr":
+			opts.StderrMode = strings.ToLower(nextArg(&i, opt))
+			switch opts.StderrMode {
+			case "merge", "tag", "separate", "local":
+			default:
+				log.Fatalf("ERROR: unrecognized stderr mode '%v', valid modes: merge, tag, separate, local", opts.StderrMode)
+			}
+		case "--summary":
+			opts.Summary = true
 		case "-t", "--timeout":
 			opts.TimeoutSecs = nextArgInt(&i, opt, 0, 1000000)
 		case "-v", "--verbose":
 			opts.Verbose++
 		case "-vv", "-vvv":
 			opts.Verbose += len(opt) - 1
+		case "--vault":
+			opts.VaultFile = nextArg(&i, opt)
+		case "--vault-passphrase-env":
+			opts.VaultPassphrase = readPasswordFromEnv(nextArg(&i, opt))
+		case "--vault-passphrase-file":
+			opts.VaultPassphrase = readPasswordFromFile(nextArg(&i, opt))
 		case "-V", "--version":
 			fmt.Printf("%v v%v\n", getProgramName(), version)
 			os.Exit(0)
@@ -144,6 +331,10 @@ func getopts() (opts options) {
 			if strings.HasPrefix(opt, "-") {
 				log.Fatalf("ERROR: unrecognized option '%v'", opt)
 			}
+			if opt == "vault" {
+				vaultCommand(opts, os.Args[i+1:])
+				os.Exit(0)
+			}
 			m := map[string]bool{}
 			opts.Hosts = parseHostString(opt, m)
 			foundHosts = true
@@ -158,10 +349,25 @@ func getopts() (opts options) {
 		opts.Command += quote(os.Args[i])
 	}
 
+	if opts.Collate && opts.Stream {
+		log.Fatalf("ERROR: --collate and --stream cannot be used together")
+	}
+	if opts.OutDirRun && len(opts.OutDir) == 0 {
+		log.Fatalf("ERROR: --outdir-run requires --outdir")
+	}
+	if opts.OutputFormat != "text" {
+		promptWriter = os.Stderr
+	}
+	if opts.OutputFormat != "text" && (opts.Collate || opts.Stream) {
+		log.Fatalf("ERROR: --output %v cannot be used with --collate or --stream", opts.OutputFormat)
+	}
+
 	// Parse auth.
 	ms := strings.Split(auth, ",")
 	for _, m := range ms {
 		switch strings.ToLower(strings.TrimSpace(m)) {
+		case "agent":
+			opts.SSHAgent = true
 		case "keyboard-interactive":
 			opts.SSHKeyboardInteractive = true
 		case "password":
@@ -169,17 +375,51 @@ func getopts() (opts options) {
 		case "public-key":
 			opts.SSHPublicKey = true
 		default:
-			log.Fatalf("ERROR: unrecognized auth mode '%v', valid modes: keyboard-interactive, password, public-key", m)
+			log.Fatalf("ERROR: unrecognized auth mode '%v', valid modes: agent, keyboard-interactive, password, public-key", m)
+		}
+	}
+
+	// Use the standard known_hosts files unless the user specified
+	// them explicitly.
+	if len(opts.KnownHostsFiles) == 0 {
+		opts.KnownHostsFiles = defaultKnownHostsFiles()
+	}
+
+	// Load the vault if it was specified or if a host refers to one of its
+	// secrets.
+	secrets := map[string]string{}
+	vaultPasswords := []passwordEntry{}
+	needVault := len(opts.VaultFile) > 0
+	for _, hi := range opts.Hosts {
+		if len(hi.Secret) > 0 {
+			needVault = true
 		}
 	}
+	if needVault {
+		secrets, vaultPasswords = loadVault(opts)
+	}
 
 	// Post pass to update the passwords for each host to avoid having to check
-	// it later.{
-	if len(opts.Password) > 0 {
-		for _, hi := range opts.Hosts {
-			if len(hi.Password) == 0 {
-				hi.Password = opts.Password
+	// it later. The hosts are updated in place, a per host password from the
+	// host spec always wins, then the vault secret, the password map, the
+	// vault patterns and then the default.
+	for i := range opts.Hosts {
+		hi := &opts.Hosts[i]
+		if len(hi.Password) == 0 && len(hi.Secret) > 0 {
+			password, found := secrets[hi.Secret]
+			if !found {
+				fatal("%v: secret '%v' not found in vault %v", hi.HostFile, hi.Secret, vaultFile(opts))
 			}
+			hi.Password = password
+		}
+		if len(hi.Password) == 0 {
+			hi.Password = lookupPassword(opts.PasswordMap, *hi)
+		}
+		if len(hi.Password) == 0 {
+			hi.Password = lookupPassword(vaultPasswords, *hi)
+		}
+		if len(hi.Password) == 0 {
+			hi.Password = opts.Password
 		}
 	}
 
@@ -196,11 +436,13 @@ func getopts() (opts options) {
 	vinfo(opts, "Cmd      = %v", opts.Command)
 	vinfo(opts, "Max Jobs = %v", opts.MaxParallelJobs)
 	vinfo(opts, "Retries  = %v", opts.NumRetries)
+	vinfo(opts, "Backoff  = %vms..%vms, retry time %vs", opts.RetryDelayMsecs, opts.RetryMaxDelayMsecs, opts.RetryTimeSecs)
 	vinfo(opts, "Timeout  = %v", opts.TimeoutSecs)
 	vinfo(opts, "Auth     = %v", auth)
+	vinfo(opts, "HostKeys = %v", opts.HostKeyPolicy)
 	vinfo(opts, "Hosts    = %v", len(opts.Hosts))
 	for i, hi := range opts.Hosts {
-		vinfo(opts, "           [%3d] %v %v %v %v", i+1, hi.ID, hi.Host, hi.Username, hi.HostFile)
+		vinfo(opts, "           [%3d] %v %v %v %v %v", i+1, hi.ID, hi.Host, hi.Username, hi.HostFile, hi.HostKey)
 	}
 
 	return
@@ -234,17 +476,21 @@ func readPasswordFromFile(fn string) (password string) {
 // Highlevel syntax: <host>[,<host>]*
 // Each host specification has the following syntax:
 //
-//   [<username>[:<password>]@]<hostname>[:<port>]
+//   [<username>[:<password>]@]<hostname>[:<port>][#<fingerprint>]
 //
 // It is okay for the password to contain an embedded
 // "@", only the last one is picked up.
 // Cannot handle commas in tbe password, make sure that is documented.
 //
+// The fingerprint pins the host key, it has the same format
+// as the output of ssh-keygen -l (SHA256:<base64>).
+//
 // Here are some examples:
 //   host1
 //   me@host1
 //   me:@dumbpassword@@host1
 //   host:22
+//   me@host1:22#SHA256:nThbg6kXUpJWGl7E1IGOCspRomTxdCARLviKw6E5SY8
 func parseHostString(data string, m map[string]bool) (hosts []hostinfo) {
 	hostSpecs := strings.Split(data, ",")
 	for _, hostSpec := range hostSpecs {
@@ -259,7 +505,7 @@ func parseHostString(data string, m map[string]bool) (hosts []hostinfo) {
 			}
 		} else {
 			// This a host specification of the form:
-			//    [<username>[:<password>]@]<host>[:<port>]
+			//    [<username>[:<password>]@]<host>[:<port>][#<fingerprint>]
 			pos := strings.LastIndex(hostSpec, "@")
 			user := ""
 			pass := ""
@@ -283,12 +529,20 @@ func parseHostString(data string, m map[string]bool) (hosts []hostinfo) {
 				host = hostSpec
 			}
 
+			// The fingerprint is always last.
+			fingerprint := ""
+			if fp := strings.Index(host, "#"); fp >= 0 {
+				fingerprint = parseFingerprint(host[fp+1:])
+				host = host[:fp]
+			}
+
 			if strings.Contains(host, ":") == false {
 				host += ":22"
 			}
 
 			hi := hostinfo{
 				Host:     host,
+				HostKey:  fingerprint,
 				Username: user,
 				Password: pass,
 				ID:       len(hosts) + 1,
@@ -299,6 +553,16 @@ func parseHostString(data string, m map[string]bool) (hosts []hostinfo) {
 	return
 }
 
+// parseFingerprint validates a pinned host key fingerprint.
+// The trailing base64 padding is removed because ssh-keygen
+// does not print it.
+func parseFingerprint(fp string) string {
+	if strings.HasPrefix(fp, "SHA256:") == false || len(fp) == len("SHA256:") {
+		fatal("invalid host key fingerprint '%v', expected SHA256:<base64>", fp)
+	}
+	return strings.TrimRight(fp, "=")
+}
+
 // parseHostFile parses a host file.
 func parseHostFile(fn string, m map[string]bool) (hosts []hostinfo) {
 	// Catch nested references to the same file to avoid infinite recursion.
@@ -314,21 +578,51 @@ func parseHostFile(fn string, m map[string]bool) (hosts []hostinfo) {
 	check(err)
 	defer ifp.Close()
 
+	// The host specs can be followed by whitespace separated
+	// settings that apply to all of the hosts on the line:
+	//    me@host1,me@host2 identity=~/.ssh/id_deploy
 	scanner := bufio.NewScanner(ifp)
+	lineno := 0
 	for scanner.Scan() {
+		lineno++
 		line := strings.TrimSpace(scanner.Text())
 		if len(line) == 0 || strings.HasPrefix(line, "#") {
 			continue
 		}
-		his := parseHostString(line, m)
+		flds := strings.Fields(line)
+		his := parseHostString(flds[0], m)
 		for _, hi := range his {
 			hi.HostFile = fn
+			for _, setting := range flds[1:] {
+				parseHostSetting(&hi, setting, fn, lineno)
+			}
 			hosts = append(hosts, hi)
 		}
 	}
 	return
 }
 
+// parseHostSetting parses a key=value setting from a host file
+// and updates the host.
+func parseHostSetting(hi *hostinfo, setting string, fn string, lineno int) {
+	kv := strings.SplitN(setting, "=", 2)
+	if len(kv) != 2 || len(kv[1]) == 0 {
+		fatal("%v:%v: invalid host setting '%v', expected <key>=<value>", fn, lineno, setting)
+	}
+	switch kv[0] {
+	case "identity":
+		keyFile := expandHome(kv[1])
+		if _, err := os.Stat(keyFile); err != nil {
+			fatal("%v:%v: %v", fn, lineno, err)
+		}
+		hi.IdentityFiles = append(hi.IdentityFiles, keyFile)
+	case "secret":
+		hi.Secret = kv[1]
+	default:
+		fatal("%v:%v: unrecognized host setting '%v'", fn, lineno, kv[0])
+	}
+}
+
 // Get the program name.
 func getProgramName() string {
 	x, _ := filepath.Abs(os.Args[0])
@@ -356,6 +650,19 @@ func quote(token string) string {
 	return r
 }
 
+// parseSignal converts a signal name like TERM or SIGTERM to the
+// ssh signal.
+func parseSignal(name string) ssh.Signal {
+	sig := ssh.Signal(strings.TrimPrefix(strings.ToUpper(name), "SIG"))
+	switch sig {
+	case ssh.SIGABRT, ssh.SIGALRM, ssh.SIGFPE, ssh.SIGHUP, ssh.SIGILL, ssh.SIGINT, ssh.SIGKILL,
+		ssh.SIGPIPE, ssh.SIGQUIT, ssh.SIGSEGV, ssh.SIGTERM, ssh.SIGUSR1, ssh.SIGUSR2:
+	default:
+		log.Fatalf("ERROR: unrecognized signal '%v', valid signals: ABRT, ALRM, FPE, HUP, ILL, INT, KILL, PIPE, QUIT, SEGV, TERM, USR1, USR2", name)
+	}
+	return sig
+}
+
 // help
 func help() {
 	f := `
@@ -364,14 +671,20 @@ USAGE
 
     Where <host-spec>:
 
-        [<username>[:<password>]@]<host>[:<port>]
-          ^           ^            ^       ^
-          |           |            |       +-- optional, port, defaults to 22
-          |           |            +---------- required, host name or IP addr
-          |           +----------------------- optional, password - commas not
-          |                                              allowed, will use -p
-          |                                              if not specified
-          +----------------------------------- optional, username, def LOGNAME
+        [<username>[:<password>]@]<host>[:<port>][#<fingerprint>]
+          ^           ^            ^       ^        ^
+          |           |            |       |        +--- optional, SHA256 host
+          |           |            |       |             key fingerprint
+          |           |            |       +------------ optional, port,
+          |           |            |                     defaults to 22
+          |           |            +-------------------- required, host name or
+          |           |                                  IP addr
+          |           +--------------------------------- optional, password -
+          |                                              commas not allowed,
+          |                                              will use -p if not
+          |                                              specified
+          +--------------------------------------------- optional, username,
+                                                         def LOGNAME
 
         +<host-file>
           ^
@@ -385,12 +698,20 @@ DESCRIPTION
     It's only goal is to provide some examples of how things work so that I
     don't forget them. It is not suitable for production.
 
-    It supports three types of authentication: password, keyboard-interactive
-    and public-key.
+    It supports four types of authentication: agent, password,
+    keyboard-interactive and public-key.
 
     It demonstrates how to set the HostKeyAlgorithms field in the
     ssh.ClientConfig and where to find the legal values (ssh -Q key).
 
+    It verifies the server host keys against the known_hosts files the same
+    way that ssh does with StrictHostKeyChecking=yes. Host certificates are
+    accepted if they are signed by a @cert-authority in known_hosts and are
+    valid for the host name and the current time.
+
+    For public-key authentication, an OpenSSH user certificate in
+    <key>-cert.pub is presented before the private key <key> itself.
+
     It also demonstrates how to start a remote interactive shell when no
     command is specified.
 
@@ -398,17 +719,38 @@ DESCRIPTION
 
     If the port is not specified, port 22 is used.
 
+    The exit status is the highest exit status of the remote commands or 255
+    if any host did not report one because it could not be reached or the
+    command did not finish.
+
+    The first ^C stops the jobs. The remote commands that are running are
+    sent the --kill-signal and have the --kill-grace period to exit, the
+    jobs that have not started are reported as cancelled and the results
+    that were collected are reported. A second ^C exits immediately.
+
     The host files referenced in the USAGE section are text files with one host
     or host-file reference per line. Lines whose first non-whitespace character
-    are '#' are ignored. Blank lines are ignored.
+    are '#' are ignored. Blank lines are ignored. The host specs on a line can
+    be followed by whitespace separated settings for those hosts. These are
+    recognized.
+
+        identity=FILE   private key for the hosts, it is tried before the -i
+                        keys, it can be specified multiple times
+        secret=NAME     password for the hosts from the vault
+
+    If a host key fingerprint is specified, the host key that the server sends
+    must have that fingerprint. The known_hosts files are not used for that
+    host. The fingerprint has the same format as "ssh-keygen -l" output. Use
+    -A to select the key type if the server has more than one host key.
 
 OPTIONS
     -a MODES, --auth MODES
                        Explicitly specify the authorization modes in a comma
-                       separated list. Three modes are recognized.
-                           1. keyboard-interactive
-                           2. password
-                           3. public-key
+                       separated list. Four modes are recognized.
+                           1. agent (keys from the ssh-agent at SSH_AUTH_SOCK)
+                           2. keyboard-interactive
+                           3. password
+                           4. public-key
                        It is case-insenstive.
                        By default all modes are enabled.
 
@@ -420,21 +762,156 @@ OPTIONS
                        To see the host key algorithms available on your system
                        run "ssh -Q key".
 
+    --collate          Group the hosts whose output, exit status and error
+                       are identical and print each distinct output once.
+                       The error is printed once in the group header. The
+                       hosts in a group are listed compactly, for example
+                       web[01-40,43]. The largest group is printed first,
+                       the others are followed by the lines that differ
+                       from it: - for the lines only in the largest group
+                       and + for the lines only in this group.
+
+    --color MODE       Color the --stream host labels. The modes are auto,
+                       always and never. Auto colors the labels when stdout
+                       is a terminal. The default is auto.
+
+    --command-timeout SEC
+                       Stop the command on a host if it runs for more than
+                       SEC seconds. The command is sent the --kill-signal
+                       and the connection is closed after the --kill-grace
+                       period. The host is reported as timed out, the
+                       other hosts keep running. The default is to never
+                       timeout.
+
+    --connect-timeout SEC
+                       The maximum number of seconds to wait for the TCP
+                       connection to a host. A host that does not answer in
+                       time fails with "connect timed out". The connection
+                       is retried like other network errors so a host that
+                       does not answer can take -r times SEC seconds. Use
+                       --retry-time to limit that, a retry is not started if
+                       its connect timeout would run past the retry time.
+                       The default is to wait as long as the operating
+                       system does.
+
     -h, --help         This help message.
 
+    --handshake-timeout SEC
+                       The maximum number of seconds for the SSH key exchange
+                       and authentication after the TCP connection is made.
+                       A host that takes longer fails with "handshake timed
+                       out". The time includes answering keyboard-interactive
+                       prompts. Handshake timeouts are not retried. The
+                       default is to never timeout.
+
+    --host-key-policy POLICY
+                       How to handle host keys. Three policies are recognized.
+                           1. strict      the host must be in known_hosts
+                           2. accept-new  unknown hosts are added to the
+                                          --known-hosts-store file, changed
+                                          keys are still rejected
+                           3. off         no host key checking, DANGEROUS
+                       The default is strict.
+
+    --keepalive-count NUM
+                       The number of keepalive requests in a row that the
+                       server can leave unanswered before the connection is
+                       considered dead. The default is 3.
+
+    --keepalive-interval SEC
+                       Send a keepalive request to the server every SEC
+                       seconds, like ssh ServerAliveInterval. If the server
+                       stops answering, the connection is closed and the
+                       host fails with "connection lost" instead of waiting
+                       forever for output. This applies to the commands and
+                       to the interactive terminal. The default is 0, no
+                       keepalives are sent.
+
+    --kill-grace SEC   The number of seconds that a command has to exit after
+                       it is sent the kill signal. The connection is closed
+                       after that. The default is 2.
+
+    --kill-signal SIG  The signal that is sent to a command that is stopped
+                       by --command-timeout, -t or ^C. The signals are ABRT,
+                       ALRM, FPE, HUP, ILL, INT, KILL, PIPE, QUIT, SEGV,
+                       TERM, USR1 and USR2. The default is TERM.
+
+    --known-hosts FILE
+                       Verify the server host keys against the keys in FILE.
+                       It can be specified multiple times.
+                       The default is ~/.ssh/known_hosts and
+                       /etc/ssh/ssh_known_hosts of the invoking user.
+                       Hashed entries, [host]:port entries and the @revoked
+                       and @cert-authority markers are supported.
+                       The connection fails if the host is not found or if
+                       the key does not match.
+
+    --known-hosts-store FILE
+                       The known_hosts file that sshx owns. It is always
+                       checked and the accept-new policy adds new host keys
+                       to it. The default is ~/.ssh/sshx_known_hosts.
+
+    -i FILE, --identity FILE
+                       Use the private key in FILE for public-key
+                       authentication. It can be specified multiple times,
+                       the keys are tried in the order given.
+                       The default is the standard ssh identities of the
+                       invoking user: ~/.ssh/id_rsa, ~/.ssh/id_ecdsa,
+                       ~/.ssh/id_ecdsa_sk, ~/.ssh/id_ed25519 and
+                       ~/.ssh/id_ed25519_sk.
+
     -j NUM, --max-jobs NUM
                        The maximum number of jobs that can be run concurrently.
-                       This option basically describes the width of the channel.
+                       It is the number of workers in the pool and therefore
+                       the maximum number of connections that are open at
+                       once. A worker starts the next job as soon as its
+                       current job is done.
                        The default is the number of hosts/jobs.
-                       If you specify 0 (unbuffered) or 1, then the jobs will
-                       complete in order but more slowly than they would if
-                       more parallelism were allowed.
+                       If you specify 0 or 1, then the jobs will run one at a
+                       time, in order.
 
     -n, --no-job-header
                        Turns off the job header for each host. The job header
                        is printed to make it easier to differentiate between
                        the output from different hosts.
 
+    --order ORDER      The order in which the job output is reported. The
+                       orders are completed and ordered. Completed reports
+                       each job as soon as it is done. Ordered reports the
+                       jobs in the order of the hosts on the command line,
+                       a job that finishes early is held until the jobs
+                       before it are reported. The default is completed.
+
+    --outdir DIR       Also write the output of each job to files in
+                       DIR/<host>/. The stdout file has the remote stdout,
+                       the stderr file has the remote stderr and the meta
+                       file has the exit status, timings, command, status
+                       and error. The host is user@host if the same host is
+                       used more than once.
+
+    --outdir-run       Write the files for this run to a timestamped
+                       directory in the --outdir directory and point the
+                       DIR/latest symlink at it. Runs that start in the
+                       same second get a -1, -2, ... suffix.
+
+    --output FORMAT    The output format. The formats are text, json and
+                       ndjson. Text is the job headers followed by the
+                       output. Json is an array with one record per host
+                       that is printed when all of the jobs are done.
+                       Ndjson is one record per line that is printed as
+                       soon as each job is done. The records have these
+                       fields.
+                           id, user, host, hostfile, cmd, stdout, stderr,
+                           exit, signal, start, end, duration, attempts,
+                           retries, status, error
+                       Status is succeeded, failed, timeout, unreachable or
+                       cancelled.
+                       Exit is null if the remote command did not report
+                       an exit status. Start and end are RFC 3339 times,
+                       they are null if the job did not start, and
+                       duration is in seconds.
+                       The default is text.
+
     -p STRING, --password STRING
                        Define the password for password and keyboard-interactive
                        authorization operations.
@@ -446,19 +923,146 @@ OPTIONS
     -P FILE, -password-file FILE
                        Read the password from a password file.
 
+    --password-command CMD
+                       Run CMD with /bin/sh and use the first line of its
+                       output as the password. This works with password
+                       managers, for example: --password-command 'pass show ssh'
+
+    --password-env VAR
+                       Read the password from the environment variable VAR.
+
+    --password-map FILE
+                       Read per host passwords from FILE. Each line has a
+                       <username>@<host> pattern followed by whitespace and
+                       the password. The patterns can contain * and ? and
+                       are matched with and without the port. The first
+                       match wins. Blank lines and lines that start with '#'
+                       are ignored. Hosts that do not match use the default
+                       password from -p, -P, --password-env or
+                       --password-command.
+                       It can be specified multiple times.
+
+    --password-scope SCOPE
+                       How often to prompt for the password when it is not
+                       specified by -p, -P or the host spec. Three scopes are
+                       recognized.
+                           1. run     prompt once for all of the hosts
+                           2. domain  prompt once for each distinct
+                                      username@domain, where the domain is
+                                      the host name without the first label
+                           3. host    prompt once for each host
+                       The default is run.
+
+    --passphrase-env VAR
+                       Read the passphrase for encrypted private keys from
+                       the environment variable VAR.
+
+    --passphrase-file FILE
+                       Read the passphrase for encrypted private keys from a
+                       file. The format is the same as the password file.
+                       If neither passphrase option is specified, you will be
+                       prompted once for each encrypted key when a server
+                       first accepts it. The decrypted key is used for all
+                       of the hosts. Keys that are in the ssh agent are
+                       signed by the agent, you are not prompted for them.
+
     -r NUM, --retries NUM
-                       The number of times to retry a TCP dial operation after
-                       a 200ms wait. The default is 10.
+                       The number of times to retry a connection that failed
+                       because of a network error, like a refused connection,
+                       a connect timeout or a dropped handshake.
+                       Authentication and host key errors and handshake
+                       timeouts are not retried. The wait between the retries
+                       starts at --retry-delay and doubles each time up to
+                       --retry-max-delay, a random part is added so that the
+                       hosts do not all retry at the same time. The default
+                       is 10.
+
+    --retry-delay MSEC The wait before the first retry in milliseconds. The
+                       default is 200.
+
+    --retry-max-delay MSEC
+                       The maximum wait between retries in milliseconds. The
+                       default is 2000.
+
+    --retry-time SEC   Stop retrying a host after SEC seconds. The default is
+                       to not limit the retry time.
+
+    --scan-keys        Also try every ~/.ssh/id_* private key of the invoking
+                       user for public-key authentication.
+
+    --stderr MODE      How to show the remote stderr. Four modes are
+                       recognized.
+                           1. merge     stdout and stderr lines in the order
+                                        they arrived
+                           2. tag       like merge but each line is prefixed
+                                        with "stdout: " or "stderr: "
+                           3. separate  the stdout lines followed by the
+                                        stderr lines
+                           4. local     stderr lines go to the local stderr
+                       The default is merge.
+
+    --stream           Print each line of output as soon as it arrives
+                       instead of waiting for the job to finish. Each line
+                       is prefixed with a [JOB HOST] label so that the
+                       lines from different hosts can be told apart. This
+                       is useful for long running commands like tail -f.
+                       The job headers are not printed, the exit status of
+                       each job is reported on its own line instead. The
+                       separate stderr mode behaves like merge because the
+                       lines cannot be held back.
+
+    --summary          Print a summary to stderr when all of the jobs are
+                       done. It has the number of hosts that succeeded,
+                       failed, timed out, were unreachable and were
+                       cancelled, the first error line for each host that
+                       did not succeed, the slowest hosts and the total
+                       wall time.
 
     -t SEC, --timeout SEC
-                       Timeout after SEC seconds. The default is to never
-                       timeout.
+                       Timeout after SEC seconds. The jobs that are still
+                       running are stopped and the jobs that have not
+                       started are not run. They are reported as timed out
+                       along with the results of the jobs that finished.
+                       For an interactive terminal sshx exits. The default
+                       is to never timeout.
 
     -v, --verbose      Increase the level of verbosity.
                        You can use -vv as shorthand to specify -v -v.
 
+    --vault FILE       The encrypted vault with the host secrets. The default
+                       is ~/.ssh/sshx_vault. The vault is only loaded for a
+                       run if this option is specified or if a host file
+                       refers to a secret. See VAULT.
+
+    --vault-passphrase-env VAR
+                       Read the vault passphrase from the environment
+                       variable VAR instead of prompting for it.
+
+    --vault-passphrase-file FILE
+                       Read the vault passphrase from a file instead of
+                       prompting for it.
+
     -V, --version      Print the program version and exit.
 
+VAULT
+    The vault keeps the host passwords out of the host files and the shell
+    history. It is a text file that is encrypted with a key derived from a
+    passphrase. Each line has the secret name, a <username>@<host> pattern
+    (or - for none) and the password, which is the rest of the line.
+
+        prod    deploy@*.prod.example.com  secret one
+        lab     -                          secret two
+
+    Host files refer to a secret by name with the secret=NAME setting. Hosts
+    that do not have a password also match the patterns, the first match wins.
+
+    These subcommands manage the vault. They use $EDITOR to edit the secrets.
+    A host named vault must be written as vault:22.
+
+        %[1]v [--vault FILE] vault create
+        %[1]v [--vault FILE] vault edit
+        %[1]v [--vault FILE] vault list
+
 EXAMPLES
     # Example 1. help
     $ %[1]v -h
@@ -501,6 +1105,9 @@ EXAMPLES
     host2:22
     me@host3:22
 
+    # a host that needs a specific key
+    deploy@host5 identity=~/.ssh/id_deploy
+
     # include another file
     +other-hosts.txt
     EOF
@@ -515,6 +1122,17 @@ EXAMPLES
     # Example 14: Timeout after 10 seconds for a group of hosts.
     $ %[1]v -t 10 +hosts-20.txt uptime
 
+    # Example 15: Trust the host keys of new hosts on first use.
+    $ %[1]v --host-key-policy accept-new +hosts-20.txt uptime
+
+    # Example 16: Pin the host key of a host.
+    $ %[1]v 'me@host1#SHA256:nThbg6kXUpJWGl7E1IGOCspRomTxdCARLviKw6E5SY8' uptime
+
+    # Example 17: Use a vault secret for the hosts in a host file.
+    $ %[1]v vault create
+    $ echo 'deploy@web1.prod.example.com secret=prod' >hosts.txt
+    $ %[1]v +hosts.txt uptime
+
 VERSION
     v%[2]v
 `
@@ -0,0 +1,87 @@
+/*
+License: The MIT License (MIT)
+
+Copyright (c) 2016 Joe Linoff
+
+Permission is hereby granted, free of charge, to any person obtaining
+a copy of this software and associated documentation files (the
+"Software"), to deal in the Software without restriction, including
+without limitation the rights to use, copy, modify, merge, publish,
+distribute, sublicense, and/or sell copies of the Software, and to
+permit persons to whom the Software is furnished to do so, subject
+to the following conditions:
+
+The above copyright notice and this permission notice shall be
+included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR
+ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+import (
+	"testing"
+)
+
+func TestParseHostString(t *testing.T) {
+	t.Setenv("LOGNAME", "login")
+	fp := "SHA256:nThbg6kXUpJWGl7E1IGOCspRomTxdCARLviKw6E5SY8"
+	tests := []struct {
+		spec string
+		want hostinfo
+	}{
+		{"host1", hostinfo{Username: "login", Host: "host1:22"}},
+		{"host1:2222", hostinfo{Username: "login", Host: "host1:2222"}},
+		{"me@host1", hostinfo{Username: "me", Host: "host1:22"}},
+		{"me:pw@host1:2222", hostinfo{Username: "me", Password: "pw", Host: "host1:2222"}},
+		{"me:@dumb@pass@@host1", hostinfo{Username: "me", Password: "@dumb@pass@", Host: "host1:22"}},
+		{"me:a:b@host1", hostinfo{Username: "me", Password: "a:b", Host: "host1:22"}},
+		{"me@10.0.0.1#" + fp, hostinfo{Username: "me", Host: "10.0.0.1:22", HostKey: fp}},
+		{"me:p@ss@host1:2222#" + fp + "=", hostinfo{Username: "me", Password: "p@ss", Host: "host1:2222", HostKey: fp}},
+	}
+	for _, tt := range tests {
+		hosts := parseHostString(tt.spec, map[string]bool{})
+		if len(hosts) != 1 {
+			t.Errorf("parseHostString(%q) = %v hosts, want 1", tt.spec, len(hosts))
+			continue
+		}
+		hi := hosts[0]
+		if hi.Username != tt.want.Username || hi.Password != tt.want.Password || hi.Host != tt.want.Host || hi.HostKey != tt.want.HostKey {
+			t.Errorf("parseHostString(%q) = %q %q %q %q, want %q %q %q %q", tt.spec,
+				hi.Username, hi.Password, hi.Host, hi.HostKey,
+				tt.want.Username, tt.want.Password, tt.want.Host, tt.want.HostKey)
+		}
+	}
+
+	// The hosts are numbered in the order they are specified.
+	hosts := parseHostString("a@host1,b@host2,host3", map[string]bool{})
+	if len(hosts) != 3 {
+		t.Fatalf("parseHostString = %v hosts, want 3", len(hosts))
+	}
+	for i, want := range []string{"host1:22", "host2:22", "host3:22"} {
+		if hosts[i].Host != want || hosts[i].ID != i+1 {
+			t.Errorf("parseHostString host %v = %+v, want %q with ID %v", i, hosts[i], want, i+1)
+		}
+	}
+}
+
+func TestParseFingerprint(t *testing.T) {
+	tests := []struct {
+		fp   string
+		want string
+	}{
+		{"SHA256:abc", "SHA256:abc"},
+		{"SHA256:abc=", "SHA256:abc"},
+		{"SHA256:nThbg6kXUpJWGl7E1IGOCspRomTxdCARLviKw6E5SY8=", "SHA256:nThbg6kXUpJWGl7E1IGOCspRomTxdCARLviKw6E5SY8"},
+	}
+	for _, tt := range tests {
+		if got := parseFingerprint(tt.fp); got != tt.want {
+			t.Errorf("parseFingerprint(%q) = %q, want %q", tt.fp, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+/*
+License: The MIT License (MIT)
+
+Copyright (c) 2016 Joe Linoff
+
+Permission is hereby granted, free of charge, to any person obtaining
+a copy of this software and associated documentation files (the
+"Software"), to deal in the Software without restriction, including
+without limitation the rights to use, copy, modify, merge, publish,
+distribute, sublicense, and/or sell copies of the Software, and to
+permit persons to whom the Software is furnished to do so, subject
+to the following conditions:
+
+The above copyright notice and this permission notice shall be
+included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR
+ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// streamPrinter prints the output lines for --stream as soon as
+// they arrive. The lines are prefixed with a label that identifies
+// the host. It is shared by all of the jobs, the mutex keeps the
+// lines from different hosts from being mixed together.
+type streamPrinter struct {
+	mutex sync.Mutex
+	width int  // width of the widest label
+	color bool // color the labels
+	mode  string
+}
+
+// The label colors, one per host in rotation.
+var streamColors = []string{
+	"\x1b[32m", // green
+	"\x1b[33m", // yellow
+	"\x1b[34m", // blue
+	"\x1b[35m", // magenta
+	"\x1b[36m", // cyan
+	"\x1b[92m", // bright green
+	"\x1b[93m", // bright yellow
+	"\x1b[94m", // bright blue
+	"\x1b[95m", // bright magenta
+	"\x1b[96m", // bright cyan
+}
+
+// newStreamPrinter sizes the labels so that the output of all
+// of the hosts lines up.
+func newStreamPrinter(opts options) *streamPrinter {
+	sp := &streamPrinter{mode: opts.StderrMode}
+	for _, hi := range opts.Hosts {
+		if n := len(streamLabel(hi)); n > sp.width {
+			sp.width = n
+		}
+	}
+	switch opts.Color {
+	case "always":
+		sp.color = true
+	case "auto":
+		sp.color = terminal.IsTerminal(int(os.Stdout.Fd()))
+	}
+	return sp
+}
+
+// streamLabel is the prefix that identifies the host of a line.
+func streamLabel(hi hostinfo) string {
+	return fmt.Sprintf("[%v %v]", hi.ID, hi.Host)
+}
+
+// print writes a single line. Each line is written with a single
+// call so that it is never split by lines from other hosts.
+func (sp *streamPrinter) print(hi hostinfo, line outputLine) {
+	label := fmt.Sprintf("%-*v", sp.width, streamLabel(hi))
+	if sp.color {
+		label = streamColors[hi.ID%len(streamColors)] + label + "\x1b[0m"
+	}
+	text := line.Text
+	if sp.mode == "tag" {
+		text = line.Stream + ": " + text
+	}
+	out := os.Stdout
+	if sp.mode == "local" && line.Stream != "stdout" {
+		out = os.Stderr
+	}
+
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	fmt.Fprintf(out, "%v %v\n", label, text)
+}
+
+// formatOutput formats the output of a job for the --stderr mode.
+// It returns the text for the local stdout and the text for the
+// local stderr. The sshx error messages are treated like stderr.
+//    merge     the lines in the order they arrived
+//    tag       the lines in the order they arrived, prefixed with
+//              the stream name
+//    separate  the stdout lines followed by the stderr lines
+//    local     the stderr lines go to the local stderr
+func formatOutput(hi hostinfo, mode string) (stdout string, stderr string) {
+	if mode == "merge" {
+		return hi.Output, ""
+	}
+	outBuf := []string{}
+	errBuf := []string{}
+	for _, line := range hi.Lines {
+		switch mode {
+		case "tag":
+			outBuf = append(outBuf, line.Stream+": "+line.Text)
+		default:
+			if line.Stream == "stdout" {
+				outBuf = append(outBuf, line.Text)
+			} else {
+				errBuf = append(errBuf, line.Text)
+			}
+		}
+	}
+	if mode == "separate" && len(errBuf) > 0 {
+		outBuf = append(outBuf, "# ---------------------------- stderr ----------------------------")
+		outBuf = append(outBuf, errBuf...)
+		errBuf = nil
+	}
+	if len(outBuf) > 0 {
+		stdout = strings.Join(outBuf, "\n") + "\n"
+	}
+	if len(errBuf) > 0 {
+		stderr = strings.Join(errBuf, "\n") + "\n"
+	}
+	return
+}
+
+// jsonResult is the record for a job in the json and ndjson output
+// formats.
+type jsonResult struct {
+	ID       int     `json:"id"`
+	User     string  `json:"user"`
+	Host     string  `json:"host"`
+	HostFile string  `json:"hostfile"`
+	Cmd      string  `json:"cmd"`
+	Stdout   string  `json:"stdout"`
+	Stderr   string  `json:"stderr"`
+	Exit     *int    `json:"exit"` // nil if there is no exit status
+	Signal   string  `json:"signal"`
+	Start    *string `json:"start"` // nil if the job did not start
+	End      *string `json:"end"`
+	Duration float64 `json:"duration"` // seconds
+	Attempts int     `json:"attempts"` // connection attempts
+	Retries  int     `json:"retries"`
+	Status   string  `json:"status"` // succeeded, failed, timeout, unreachable or cancelled
+	Error    string  `json:"error"`
+}
+
+// newJSONResult creates the record for a job. The sshx error
+// messages are not part of stderr, they are reported in the error
+// field.
+func newJSONResult(hi hostinfo, opts options) jsonResult {
+	r := jsonResult{
+		ID:       hi.ID,
+		User:     hi.Username,
+		Host:     hi.Host,
+		HostFile: hi.HostFile,
+		Cmd:      opts.Command,
+		Signal:   hi.ExitSignal,
+		Attempts: hi.Attempts,
+		Status:   hi.Status,
+		Error:    hi.Error,
+	}
+	for _, line := range hi.Lines {
+		switch line.Stream {
+		case "stdout":
+			r.Stdout += line.Text + "\n"
+		case "stderr":
+			r.Stderr += line.Text + "\n"
+		}
+	}
+	if hi.Attempts > 0 {
+		r.Retries = hi.Attempts - 1
+	}
+	if hi.ExitStatus >= 0 {
+		exit := hi.ExitStatus
+		r.Exit = &exit
+	}
+	if !hi.Start.IsZero() {
+		start := hi.Start.Format(time.RFC3339Nano)
+		end := hi.End.Format(time.RFC3339Nano)
+		r.Start = &start
+		r.End = &end
+		r.Duration = hi.End.Sub(hi.Start).Seconds()
+	}
+	return r
+}
+
+// printJSON writes a value to stdout as json. It is indented for
+// the json format and on a single line for ndjson.
+func printJSON(v interface{}, indent bool) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	if indent {
+		enc.SetIndent("", "  ")
+	}
+	check(enc.Encode(v))
+}
+
+// resultsDir writes the output of each job to its own directory
+// for --outdir.
+//    DIR/<host>/stdout
+//    DIR/<host>/stderr
+//    DIR/<host>/meta
+type resultsDir struct {
+	dir   string
+	names map[int]string // directory name by job id
+}
+
+// newResultsDir creates the results directory. For --outdir-run a
+// timestamped directory is created for the run and the latest
+// symlink is pointed at it.
+// The host directory names are chosen up front so that they are
+// unique even if a host appears more than once.
+func newResultsDir(opts options) *resultsDir {
+	rd := &resultsDir{dir: opts.OutDir, names: map[int]string{}}
+	if opts.OutDirRun {
+		// Runs that start in the same second get a numbered
+		// directory, an existing run is never written to.
+		check(os.MkdirAll(opts.OutDir, 0755))
+		stamp := time.Now().Format("20060102-150405")
+		run := stamp
+		for i := 1; ; i++ {
+			rd.dir = filepath.Join(opts.OutDir, run)
+			err := os.Mkdir(rd.dir, 0755)
+			if err == nil {
+				break
+			}
+			if os.IsExist(err) == false {
+				check(err)
+			}
+			run = fmt.Sprintf("%v-%v", stamp, i)
+		}
+
+		// Replace the link atomically so that readers never see
+		// it missing.
+		latest := filepath.Join(opts.OutDir, "latest")
+		tmp := latest + ".tmp-" + run
+		check(os.Symlink(run, tmp))
+		check(os.Rename(tmp, latest))
+	}
+	check(os.MkdirAll(rd.dir, 0755))
+	vinfo(opts, "   results directory: %v", rd.dir)
+
+	count := map[string]int{}
+	for _, hi := range opts.Hosts {
+		count[strings.TrimSuffix(hi.Host, ":22")]++
+	}
+	used := map[string]bool{}
+	for _, hi := range opts.Hosts {
+		name := strings.TrimSuffix(hi.Host, ":22")
+		if count[name] > 1 {
+			name = hi.Username + "@" + name
+		}
+		if used[name] {
+			name = fmt.Sprintf("%v-%v", name, hi.ID)
+		}
+		used[name] = true
+		rd.names[hi.ID] = name
+	}
+	return rd
+}
+
+// write creates the files for a job.
+func (rd *resultsDir) write(hi hostinfo, opts options) {
+	dir := filepath.Join(rd.dir, rd.names[hi.ID])
+	check(os.MkdirAll(dir, 0755))
+
+	r := newJSONResult(hi, opts)
+	exit := "none"
+	if r.Exit != nil {
+		exit = fmt.Sprintf("%v", *r.Exit)
+	}
+	meta := fmt.Sprintf(`id: %v
+user: %v
+host: %v
+hostfile: %v
+cmd: %v
+exit: %v
+signal: %v
+start: %v
+end: %v
+duration: %v
+attempts: %v
+retries: %v
+status: %v
+error: %v
+`, r.ID, r.User, r.Host, r.HostFile, r.Cmd, exit, r.Signal, r.Start, r.End, r.Duration, r.Attempts, r.Retries, r.Status, r.Error)
+
+	check(ioutil.WriteFile(filepath.Join(dir, "stdout"), []byte(r.Stdout), 0644))
+	check(ioutil.WriteFile(filepath.Join(dir, "stderr"), []byte(r.Stderr), 0644))
+	check(ioutil.WriteFile(filepath.Join(dir, "meta"), []byte(meta), 0644))
+}
@@ -0,0 +1,127 @@
+/*
+License: The MIT License (MIT)
+
+Copyright (c) 2016 Joe Linoff
+
+Permission is hereby granted, free of charge, to any person obtaining
+a copy of this software and associated documentation files (the
+"Software"), to deal in the Software without restriction, including
+without limitation the rights to use, copy, modify, merge, publish,
+distribute, sublicense, and/or sell copies of the Software, and to
+permit persons to whom the Software is furnished to do so, subject
+to the following conditions:
+
+The above copyright notice and this permission notice shall be
+included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR
+ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// passwordEntry is a password map entry. The pattern is matched
+// against <username>@<host> with and without the port.
+type passwordEntry struct {
+	pattern  string
+	password string
+}
+
+// readPasswordFromEnv reads the password from an environment
+// variable, it must be set.
+func readPasswordFromEnv(name string) string {
+	password, found := os.LookupEnv(name)
+	if !found || len(password) == 0 {
+		fatal("environment variable '%v' is not set or empty", name)
+	}
+	return password
+}
+
+// readPasswordFromCommand runs a local helper command like
+// "pass show prod/ssh" and uses the first line of its output.
+// The helper can talk to the user through stderr and the tty.
+func readPasswordFromCommand(command string) string {
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		fatal("password command '%v' failed: %v", command, err)
+	}
+	line := string(out)
+	if pos := strings.IndexByte(line, '\n'); pos >= 0 {
+		line = line[:pos]
+	}
+	line = strings.TrimRight(line, "\r")
+	if len(line) == 0 {
+		fatal("password command '%v' did not output a password", command)
+	}
+	return line
+}
+
+// readPasswordMap reads a password file that is keyed by host.
+// Each line has a <username>@<host> pattern followed by whitespace
+// and the password, the rest of the line:
+//    me@host1       secret1
+//    deploy@*.prod  secret two
+//    *@*            default
+// The patterns use the path.Match syntax, the first match wins.
+// Blank lines and lines that start with '#' are ignored, the
+// pattern cannot start with a '#' but the password can.
+func readPasswordMap(fn string) (entries []passwordEntry) {
+	ifp, err := os.Open(fn)
+	check(err)
+	defer ifp.Close()
+
+	scanner := bufio.NewScanner(ifp)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pos := strings.IndexAny(line, " \t")
+		if pos < 0 {
+			fatal("%v:%v: expected <username>@<host> <password>", fn, lineno)
+		}
+		entry := passwordEntry{
+			pattern:  line[:pos],
+			password: strings.TrimSpace(line[pos:]),
+		}
+		if _, err := path.Match(entry.pattern, ""); err != nil {
+			fatal("%v:%v: invalid pattern '%v': %v", fn, lineno, entry.pattern, err)
+		}
+		entries = append(entries, entry)
+	}
+	return
+}
+
+// lookupPassword returns the password map entry for a host or
+// the empty string if there is no match.
+func lookupPassword(entries []passwordEntry, hi hostinfo) string {
+	names := []string{hi.Username + "@" + hi.Host}
+	if pos := strings.LastIndex(hi.Host, ":"); pos >= 0 {
+		names = append(names, hi.Username+"@"+hi.Host[:pos])
+	}
+	for _, e := range entries {
+		for _, name := range names {
+			if ok, _ := path.Match(e.pattern, name); ok {
+				return e.password
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,87 @@
+/*
+License: The MIT License (MIT)
+
+Copyright (c) 2016 Joe Linoff
+
+Permission is hereby granted, free of charge, to any person obtaining
+a copy of this software and associated documentation files (the
+"Software"), to deal in the Software without restriction, including
+without limitation the rights to use, copy, modify, merge, publish,
+distribute, sublicense, and/or sell copies of the Software, and to
+permit persons to whom the Software is furnished to do so, subject
+to the following conditions:
+
+The above copyright notice and this permission notice shall be
+included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR
+ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadPasswordMap(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "passwords")
+	data := "# comment\n\nme@host1       secret1\ndeploy@*.prod\tsecret two \n*@*  #hash\n"
+	if err := os.WriteFile(fn, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	entries := readPasswordMap(fn)
+	want := []passwordEntry{
+		{pattern: "me@host1", password: "secret1"},
+		{pattern: "deploy@*.prod", password: "secret two"},
+		{pattern: "*@*", password: "#hash"},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("readPasswordMap = %v entries, want %v", len(entries), len(want))
+	}
+	for i := range want {
+		if entries[i] != want[i] {
+			t.Errorf("entry %v = %+v, want %+v", i, entries[i], want[i])
+		}
+	}
+}
+
+func TestLookupPassword(t *testing.T) {
+	entries := []passwordEntry{
+		{pattern: "me@host1:2222", password: "port"},
+		{pattern: "me@host1", password: "noport"},
+		{pattern: "deploy@*.prod", password: "prod"},
+		{pattern: "root@10.0.0.?:22", password: "root"},
+	}
+	tests := []struct {
+		user string
+		host string
+		want string
+	}{
+		{"me", "host1:2222", "port"},
+		{"me", "host1:22", "noport"},
+		{"you", "host1:22", ""},
+		{"deploy", "web1.prod:22", "prod"},
+		{"deploy", "web1.test:22", ""},
+		{"root", "10.0.0.1:22", "root"},
+		{"root", "10.0.0.1:2222", ""},
+	}
+	for _, tt := range tests {
+		hi := hostinfo{Username: tt.user, Host: tt.host}
+		if got := lookupPassword(entries, hi); got != tt.want {
+			t.Errorf("lookupPassword(%q) = %q, want %q", tt.user+"@"+tt.host, got, tt.want)
+		}
+	}
+
+	// The first match wins.
+	entries = []passwordEntry{{pattern: "*@*", password: "first"}, {pattern: "me@host1", password: "second"}}
+	if got := lookupPassword(entries, hostinfo{Username: "me", Host: "host1:22"}); got != "first" {
+		t.Errorf("lookupPassword = %q, want %q", got, "first")
+	}
+}
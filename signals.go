@@ -0,0 +1,112 @@
+/*
+License: The MIT License (MIT)
+
+Copyright (c) 2016 Joe Linoff
+
+Permission is hereby granted, free of charge, to any person obtaining
+a copy of this software and associated documentation files (the
+"Software"), to deal in the Software without restriction, including
+without limitation the rights to use, copy, modify, merge, publish,
+distribute, sublicense, and/or sell copies of the Software, and to
+permit persons to whom the Software is furnished to do so, subject
+to the following conditions:
+
+The above copyright notice and this permission notice shall be
+included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR
+ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// interrupts is the state of the interrupt handler. There is a
+// single handler for the whole program so that the password
+// prompts and the running jobs do not fight over ^C.
+var interrupts struct {
+	sync.Mutex
+	once    sync.Once
+	term    *terminal.State    // restored if a prompt is interrupted
+	cancel  context.CancelFunc // stops the running jobs
+	cleanup func()             // runs before an interrupt exits
+}
+
+// catchInterrupts installs the interrupt handler.
+//    ^C at a prompt restores the terminal and exits.
+//    The first ^C during a run stops the jobs, the results that
+//    were collected are still reported.
+//    The second ^C exits immediately.
+func catchInterrupts() {
+	interrupts.once.Do(func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			for range c {
+				interrupts.Lock()
+				term := interrupts.term
+				cancel := interrupts.cancel
+				interrupts.cancel = nil
+				cleanup := interrupts.cleanup
+				interrupts.Unlock()
+
+				if cancel == nil && cleanup != nil {
+					cleanup()
+				}
+
+				if term != nil {
+					_ = terminal.Restore(syscall.Stdin, term)
+					fmt.Fprintln(promptWriter, "")
+					os.Exit(1)
+				}
+				if cancel == nil {
+					os.Exit(130)
+				}
+				warning("interrupted, stopping the jobs, press ^C again to exit now")
+				cancel()
+			}
+		}()
+	})
+}
+
+// interruptTerminal sets the terminal state to restore if a prompt
+// is interrupted, nil when the prompt is done.
+func interruptTerminal(state *terminal.State) {
+	catchInterrupts()
+	interrupts.Lock()
+	defer interrupts.Unlock()
+	interrupts.term = state
+}
+
+// interruptCancel sets the function that stops the running jobs,
+// nil when the run is done.
+func interruptCancel(cancel context.CancelFunc) {
+	catchInterrupts()
+	interrupts.Lock()
+	defer interrupts.Unlock()
+	interrupts.cancel = cancel
+}
+
+// interruptCleanup sets the function that runs before an
+// interrupt exits, like removing a temporary file, nil when it is
+// no longer needed.
+func interruptCleanup(cleanup func()) {
+	catchInterrupts()
+	interrupts.Lock()
+	defer interrupts.Unlock()
+	interrupts.cleanup = cleanup
+}
@@ -0,0 +1,179 @@
+/*
+License: The MIT License (MIT)
+
+Copyright (c) 2016 Joe Linoff
+
+Permission is hereby granted, free of charge, to any person obtaining
+a copy of this software and associated documentation files (the
+"Software"), to deal in the Software without restriction, including
+without limitation the rights to use, copy, modify, merge, publish,
+distribute, sublicense, and/or sell copies of the Software, and to
+permit persons to whom the Software is furnished to do so, subject
+to the following conditions:
+
+The above copyright notice and this permission notice shall be
+included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR
+ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// timeoutError reports that a job was stopped because it ran too
+// long. It is a net.Error so that it is classified like the network
+// timeouts.
+type timeoutError struct {
+	what  string // command, run, ...
+	after time.Duration
+}
+
+func (e timeoutError) Error() string {
+	return fmt.Sprintf("%v timed out after %v", e.what, e.after)
+}
+
+func (e timeoutError) Timeout() bool   { return true }
+func (e timeoutError) Temporary() bool { return false }
+
+// connectionLostError reports a connection that stopped answering
+// the keepalive requests. It is a timeout.
+type connectionLostError struct {
+	missed   int
+	interval time.Duration
+}
+
+func (e connectionLostError) Error() string {
+	return fmt.Sprintf("connection lost, %v keepalive requests sent every %v were not answered", e.missed, e.interval)
+}
+
+func (e connectionLostError) Timeout() bool   { return true }
+func (e connectionLostError) Temporary() bool { return false }
+
+// cancelledError reports that a job was stopped by an interrupt.
+type cancelledError struct {
+	started bool
+}
+
+func (e cancelledError) Error() string {
+	if e.started {
+		return "cancelled by an interrupt"
+	}
+	return "cancelled, the job was not started"
+}
+
+// stoppedError explains why the run context stopped a job.
+func stoppedError(err error, opts options, started bool) error {
+	if err == context.DeadlineExceeded {
+		return timeoutError{what: "run", after: time.Duration(opts.TimeoutSecs) * time.Second}
+	}
+	return cancelledError{started: started}
+}
+
+// failureStatus classifies the error that ended a job. The host is
+// unreachable if the connection could not be made, the ssh errors
+// after that, like authentication failures, are failures.
+// The errors are unwrapped because the ssh package wraps the
+// network errors during the handshake.
+func failureStatus(err error, connected bool) string {
+	var ce cancelledError
+	if errors.As(err, &ce) {
+		return "cancelled"
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && connected == false {
+		return "unreachable"
+	}
+	return "failed"
+}
+
+// failureLine is the first line that explains why a job did not
+// succeed: the sshx error, the first stderr line or the exit
+// status.
+func failureLine(hi hostinfo) string {
+	if len(hi.Error) > 0 {
+		return strings.SplitN(strings.TrimSpace(hi.Error), "\n", 2)[0]
+	}
+	for _, line := range hi.Lines {
+		if line.Stream == "stderr" && len(strings.TrimSpace(line.Text)) > 0 {
+			return line.Text
+		}
+	}
+	return "exit " + exitString(hi)
+}
+
+// printSummary reports how the jobs finished to stderr.
+func printSummary(results []hostinfo, wall time.Duration) {
+	counts := map[string]int{}
+	failures := []hostinfo{}
+	for _, hi := range results {
+		counts[hi.Status]++
+		if hi.Status != "succeeded" {
+			failures = append(failures, hi)
+		}
+	}
+
+	w := os.Stderr
+	fmt.Fprintf(w, `
+# ================================================================
+# Summary
+# Hosts      : %[1]v
+# Succeeded  : %[2]v
+# Failed     : %[3]v
+# Timed out  : %[4]v
+# Unreachable: %[5]v
+# Cancelled  : %[6]v
+# Wall time  : %[7]v
+# ================================================================
+`, len(results), counts["succeeded"], counts["failed"], counts["timeout"], counts["unreachable"],
+		counts["cancelled"], wall.Round(time.Millisecond))
+
+	if len(failures) > 0 {
+		fmt.Fprintf(w, "# Failures\n")
+		for _, hi := range failures {
+			attempts := ""
+			if hi.Attempts > 1 {
+				attempts = fmt.Sprintf(" (%v attempts)", hi.Attempts)
+			}
+			fmt.Fprintf(w, "#   [%v] %v@%v %v%v: %v\n", hi.ID, hi.Username, hi.Host, hi.Status, attempts, failureLine(hi))
+		}
+	}
+
+	// The slowest hosts that ran.
+	slowest := []hostinfo{}
+	for _, hi := range results {
+		if !hi.Start.IsZero() {
+			slowest = append(slowest, hi)
+		}
+	}
+	sort.SliceStable(slowest, func(i, j int) bool {
+		return slowest[i].End.Sub(slowest[i].Start) > slowest[j].End.Sub(slowest[j].Start)
+	})
+	if len(slowest) > 5 {
+		slowest = slowest[:5]
+	}
+	if len(slowest) > 0 {
+		fmt.Fprintf(w, "# Slowest\n")
+		for _, hi := range slowest {
+			fmt.Fprintf(w, "#   [%v] %v@%v %v\n", hi.ID, hi.Username, hi.Host, hi.End.Sub(hi.Start).Round(time.Millisecond))
+		}
+	}
+}
@@ -0,0 +1,64 @@
+/*
+License: The MIT License (MIT)
+
+Copyright (c) 2016 Joe Linoff
+
+Permission is hereby granted, free of charge, to any person obtaining
+a copy of this software and associated documentation files (the
+"Software"), to deal in the Software without restriction, including
+without limitation the rights to use, copy, modify, merge, publish,
+distribute, sublicense, and/or sell copies of the Software, and to
+permit persons to whom the Software is furnished to do so, subject
+to the following conditions:
+
+The above copyright notice and this permission notice shall be
+included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR
+ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestFailureStatus(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	reset := &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+	tests := []struct {
+		name      string
+		err       error
+		connected bool
+		want      string
+	}{
+		{"interrupt before the start", cancelledError{started: false}, false, "cancelled"},
+		{"interrupt while running", cancelledError{started: true}, true, "cancelled"},
+		{"connect timeout", timeoutError{what: "connect", after: time.Second}, false, "timeout"},
+		{"handshake timeout", timeoutError{what: "handshake", after: time.Second}, false, "timeout"},
+		{"command timeout", timeoutError{what: "command", after: time.Second}, true, "timeout"},
+		{"connection lost", connectionLostError{missed: 3, interval: time.Second}, true, "timeout"},
+		{"connection refused", refused, false, "unreachable"},
+		{"connection reset after connecting", refused, true, "failed"},
+		{"reset during the handshake", fmt.Errorf("ssh: handshake failed: %w", reset), false, "unreachable"},
+		{"wrapped connect timeout", fmt.Errorf("host1: %w", timeoutError{what: "connect", after: time.Second}), false, "timeout"},
+		{"wrapped interrupt", fmt.Errorf("host1: %w", cancelledError{started: true}), true, "cancelled"},
+		{"authentication", errors.New("ssh: handshake failed: ssh: unable to authenticate"), false, "failed"},
+		{"remote error", errors.New("Process exited with status 1"), true, "failed"},
+	}
+	for _, tt := range tests {
+		if got := failureStatus(tt.err, tt.connected); got != tt.want {
+			t.Errorf("failureStatus(%v) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
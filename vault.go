@@ -0,0 +1,326 @@
+/*
+License: The MIT License (MIT)
+
+Copyright (c) 2016 Joe Linoff
+
+Permission is hereby granted, free of charge, to any person obtaining
+a copy of this software and associated documentation files (the
+"Software"), to deal in the Software without restriction, including
+without limitation the rights to use, copy, modify, merge, publish,
+distribute, sublicense, and/or sell copies of the Software, and to
+permit persons to whom the Software is furnished to do so, subject
+to the following conditions:
+
+The above copyright notice and this permission notice shall be
+included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR
+ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// The vault is a text file of secrets that is encrypted with
+// AES-256-GCM using a key derived from a passphrase with scrypt.
+// The encrypted file looks like this:
+//    sshx-vault v1
+//    <base64 salt>
+//    <base64 nonce>
+//    <base64 ciphertext>
+// The plaintext has one secret per line: the secret name, a
+// <username>@<host> pattern (or - for no pattern) and the
+// password, which is the rest of the line.
+const vaultHeader = "sshx-vault v1"
+
+// vaultTemplate is the plaintext of a new vault.
+const vaultTemplate = `# sshx vault
+# Each line has the secret name, a <username>@<host> pattern (or - for
+# none) and the password, which is the rest of the line.
+# Host files refer to a secret by name with secret=<name>.
+# Hosts without a password also match the patterns, first match wins.
+#
+#   prod    deploy@*.prod.example.com  secret one
+#   lab     -                          secret two
+`
+
+// vaultEntry is a secret in the vault.
+type vaultEntry struct {
+	name     string
+	pattern  string
+	password string
+}
+
+// vaultFile returns the vault file from --vault or the default.
+func vaultFile(opts options) string {
+	if len(opts.VaultFile) > 0 {
+		return opts.VaultFile
+	}
+	return path.Join(homeDir(), ".ssh", "sshx_vault")
+}
+
+// vaultPassphrase returns the passphrase from --vault-passphrase-env
+// or --vault-passphrase-file or prompts for it.
+func vaultPassphrase(opts options, confirm bool) string {
+	if len(opts.VaultPassphrase) > 0 {
+		return opts.VaultPassphrase
+	}
+	p := getPassword(fmt.Sprintf("Enter passphrase for vault '%v': ", vaultFile(opts)))
+	if confirm && p != getPassword("Enter the same passphrase again: ") {
+		fatal("the passphrases do not match")
+	}
+	if len(p) == 0 {
+		fatal("the vault passphrase cannot be empty")
+	}
+	return p
+}
+
+// vaultKey derives the encryption key from the passphrase.
+func vaultKey(passphrase string, salt []byte) []byte {
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	check(err)
+	return key
+}
+
+// encryptVault encrypts the plaintext secrets.
+func encryptVault(passphrase string, plaintext []byte) []byte {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	check(err)
+	block, err := aes.NewCipher(vaultKey(passphrase, salt))
+	check(err)
+	gcm, err := cipher.NewGCM(block)
+	check(err)
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	check(err)
+	ciphertext := gcm.Seal(nil, nonce, plaintext, []byte(vaultHeader))
+
+	b64 := base64.StdEncoding.EncodeToString
+	return []byte(strings.Join([]string{vaultHeader, b64(salt), b64(nonce), b64(ciphertext)}, "\n") + "\n")
+}
+
+// decryptVault decrypts the vault data.
+func decryptVault(passphrase string, data []byte) ([]byte, error) {
+	flds := strings.Fields(strings.TrimPrefix(string(data), vaultHeader))
+	if strings.HasPrefix(string(data), vaultHeader) == false || len(flds) != 3 {
+		return nil, fmt.Errorf("not an sshx vault")
+	}
+	parts := [][]byte{}
+	for _, f := range flds {
+		b, err := base64.StdEncoding.DecodeString(f)
+		if err != nil {
+			return nil, fmt.Errorf("corrupt vault: %v", err)
+		}
+		parts = append(parts, b)
+	}
+	block, err := aes.NewCipher(vaultKey(passphrase, parts[0]))
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(parts[1]) != gcm.NonceSize() {
+		return nil, fmt.Errorf("corrupt vault: bad nonce")
+	}
+	plaintext, err := gcm.Open(nil, parts[1], parts[2], []byte(vaultHeader))
+	if err != nil {
+		return nil, fmt.Errorf("wrong passphrase or corrupt vault")
+	}
+	return plaintext, nil
+}
+
+// parseVault parses the plaintext secrets.
+func parseVault(plaintext []byte) (entries []vaultEntry, err error) {
+	names := map[string]bool{}
+	scanner := bufio.NewScanner(bytes.NewReader(plaintext))
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, rest := splitField(line)
+		pattern, password := splitField(rest)
+		if len(password) == 0 {
+			return nil, fmt.Errorf("line %v: expected <name> <pattern> <password>", lineno)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("line %v: duplicate secret name '%v'", lineno, name)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("line %v: invalid pattern '%v': %v", lineno, pattern, err)
+		}
+		names[name] = true
+		entries = append(entries, vaultEntry{name: name, pattern: pattern, password: password})
+	}
+	return
+}
+
+// splitField splits off the first whitespace separated field.
+func splitField(s string) (field string, rest string) {
+	pos := strings.IndexAny(s, " \t")
+	if pos < 0 {
+		return s, ""
+	}
+	return s[:pos], strings.TrimSpace(s[pos:])
+}
+
+// loadVault decrypts the vault for a run. It returns the secrets
+// by name and the patterns for the hosts that do not refer to a
+// secret.
+func loadVault(opts options) (secrets map[string]string, patterns []passwordEntry) {
+	fn := vaultFile(opts)
+	vinfo(opts, "loading vault %v", fn)
+	data, err := ioutil.ReadFile(fn)
+	check(err)
+	plaintext, err := decryptVault(vaultPassphrase(opts, false), data)
+	if err != nil {
+		fatal("%v: %v", fn, err)
+	}
+	entries, err := parseVault(plaintext)
+	if err != nil {
+		fatal("%v: %v", fn, err)
+	}
+	secrets = map[string]string{}
+	for _, e := range entries {
+		secrets[e.name] = e.password
+		if e.pattern != "-" {
+			patterns = append(patterns, passwordEntry{pattern: e.pattern, password: e.password})
+		}
+	}
+	return
+}
+
+// saveVault encrypts the plaintext and replaces the vault file.
+func saveVault(fn string, passphrase string, plaintext []byte) {
+	check(os.MkdirAll(path.Dir(fn), 0700))
+	tmp := fn + ".tmp"
+	check(ioutil.WriteFile(tmp, encryptVault(passphrase, plaintext), 0600))
+	check(os.Rename(tmp, fn))
+}
+
+// editVault lets the user edit the plaintext with $EDITOR. The
+// plaintext is only on disk while the editor runs, the file is
+// removed before an error is reported or an interrupt exits. The
+// user can edit it again if it does not parse.
+func editVault(plaintext []byte) ([]byte, error) {
+	dir := ""
+	if st, err := os.Stat("/dev/shm"); err == nil && st.IsDir() {
+		dir = "/dev/shm" // keep it off of the disk if possible
+	}
+	tf, err := ioutil.TempFile(dir, "sshx-vault-")
+	if err != nil {
+		return nil, err
+	}
+	remove := func() { os.Remove(tf.Name()) }
+	interruptCleanup(remove)
+	defer interruptCleanup(nil)
+	defer remove()
+	_, err = tf.Write(plaintext)
+	if err1 := tf.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	editor := os.Getenv("EDITOR")
+	if len(editor) == 0 {
+		editor = "vi"
+	}
+	for {
+		cmd := exec.Command("/bin/sh", "-c", editor+` "$1"`, "sh", tf.Name())
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return nil, fmt.Errorf("editor '%v' failed: %v", editor, err)
+		}
+		plaintext, err = ioutil.ReadFile(tf.Name())
+		if err != nil {
+			return nil, err
+		}
+		if _, err := parseVault(plaintext); err != nil {
+			fmt.Printf("ERROR: %v\n", err)
+			if strings.HasPrefix(strings.ToLower(prompt("edit again", "y")), "y") {
+				continue
+			}
+			return nil, fmt.Errorf("the vault was not changed")
+		}
+		return plaintext, nil
+	}
+}
+
+// vaultCommand runs the vault subcommands:
+//    create   create a new vault and edit it
+//    edit     edit the secrets
+//    list     list the secret names and patterns, not the passwords
+func vaultCommand(opts options, args []string) {
+	if len(args) != 1 {
+		fatal("expected a vault subcommand: create, edit or list")
+	}
+	fn := vaultFile(opts)
+	switch args[0] {
+	case "create":
+		if _, err := os.Stat(fn); err == nil {
+			fatal("vault '%v' already exists", fn)
+		}
+		passphrase := vaultPassphrase(opts, true)
+		plaintext, err := editVault([]byte(vaultTemplate))
+		check(err)
+		saveVault(fn, passphrase, plaintext)
+		info("created %v", fn)
+	case "edit":
+		data, err := ioutil.ReadFile(fn)
+		check(err)
+		passphrase := vaultPassphrase(opts, false)
+		plaintext, err := decryptVault(passphrase, data)
+		if err != nil {
+			fatal("%v: %v", fn, err)
+		}
+		plaintext, err = editVault(plaintext)
+		check(err)
+		saveVault(fn, passphrase, plaintext)
+		info("updated %v", fn)
+	case "list":
+		data, err := ioutil.ReadFile(fn)
+		check(err)
+		plaintext, err := decryptVault(vaultPassphrase(opts, false), data)
+		if err != nil {
+			fatal("%v: %v", fn, err)
+		}
+		entries, err := parseVault(plaintext)
+		if err != nil {
+			fatal("%v: %v", fn, err)
+		}
+		for _, e := range entries {
+			fmt.Printf("%-24v %v\n", e.name, e.pattern)
+		}
+	default:
+		fatal("unrecognized vault subcommand '%v', valid subcommands: create, edit, list", args[0])
+	}
+}
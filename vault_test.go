@@ -0,0 +1,110 @@
+/*
+License: The MIT License (MIT)
+
+Copyright (c) 2016 Joe Linoff
+
+Permission is hereby granted, free of charge, to any person obtaining
+a copy of this software and associated documentation files (the
+"Software"), to deal in the Software without restriction, including
+without limitation the rights to use, copy, modify, merge, publish,
+distribute, sublicense, and/or sell copies of the Software, and to
+permit persons to whom the Software is furnished to do so, subject
+to the following conditions:
+
+The above copyright notice and this permission notice shall be
+included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR
+ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestVaultRoundTrip(t *testing.T) {
+	plaintext := []byte("db prod-db* s3cret\nweb web?? p@ss word\n")
+	data := encryptVault("passphrase", plaintext)
+	if bytes.Contains(data, []byte("s3cret")) {
+		t.Fatalf("encrypted vault contains the plaintext")
+	}
+	got, err := decryptVault("passphrase", data)
+	if err != nil {
+		t.Fatalf("decryptVault: %v", err)
+	}
+	if bytes.Equal(got, plaintext) == false {
+		t.Errorf("decryptVault = %q, want %q", got, plaintext)
+	}
+
+	// The salt and nonce are random so the same secrets never
+	// encrypt to the same vault.
+	if bytes.Equal(data, encryptVault("passphrase", plaintext)) {
+		t.Errorf("two encryptions of the same secrets are identical")
+	}
+}
+
+func TestVaultDecryptErrors(t *testing.T) {
+	data := encryptVault("passphrase", []byte("db * s3cret\n"))
+	flds := strings.Split(strings.TrimSpace(string(data)), "\n")
+	tampered := strings.Join([]string{flds[0], flds[1], flds[2], "AAAA" + flds[3][4:]}, "\n")
+	tests := []struct {
+		name       string
+		passphrase string
+		data       string
+	}{
+		{"wrong passphrase", "wrong", string(data)},
+		{"empty passphrase", "", string(data)},
+		{"tampered ciphertext", "passphrase", tampered},
+		{"not a vault", "passphrase", "db * s3cret\n"},
+		{"missing fields", "passphrase", vaultHeader + "\nAAAA\n"},
+		{"bad base64", "passphrase", vaultHeader + "\n!!!!\n!!!!\n!!!!\n"},
+	}
+	for _, tt := range tests {
+		if got, err := decryptVault(tt.passphrase, []byte(tt.data)); err == nil {
+			t.Errorf("%v: decryptVault = %q, want an error", tt.name, got)
+		}
+	}
+}
+
+func TestParseVault(t *testing.T) {
+	entries, err := parseVault([]byte("# comment\n\ndb prod-db* s3cret\nweb\tweb?? p@ss word \n"))
+	if err != nil {
+		t.Fatalf("parseVault: %v", err)
+	}
+	want := []vaultEntry{
+		{name: "db", pattern: "prod-db*", password: "s3cret"},
+		{name: "web", pattern: "web??", password: "p@ss word"},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("parseVault = %v entries, want %v", len(entries), len(want))
+	}
+	for i := range want {
+		if entries[i] != want[i] {
+			t.Errorf("entry %v = %+v, want %+v", i, entries[i], want[i])
+		}
+	}
+
+	tests := []struct {
+		name      string
+		plaintext string
+		errText   string
+	}{
+		{"duplicate name", "db a* one\nweb b* two\ndb c* three\n", "line 3: duplicate secret name 'db'"},
+		{"missing password", "db a*\n", "line 1: expected <name> <pattern> <password>"},
+		{"invalid pattern", "db [a* one\n", "line 1: invalid pattern '[a*'"},
+	}
+	for _, tt := range tests {
+		_, err := parseVault([]byte(tt.plaintext))
+		if err == nil || strings.HasPrefix(err.Error(), tt.errText) == false {
+			t.Errorf("%v: parseVault error = %v, want %q", tt.name, err, tt.errText)
+		}
+	}
+}